@@ -0,0 +1,274 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// keyColumn is the flag.Value behind -k: a 1-based field number, or
+// "last" for the final field of every line.
+type keyColumn struct {
+	column *int
+	last   *bool
+}
+
+func (k keyColumn) String() string {
+	switch {
+	case k.last != nil && *k.last:
+		return "last"
+	case k.column != nil && *k.column > 0:
+		return strconv.Itoa(*k.column)
+	}
+	return ""
+}
+
+func (k keyColumn) Set(v string) error {
+	if v == "last" {
+		*k.column, *k.last = 0, true
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return fmt.Errorf("want a field number or \"last\", got %q", v)
+	}
+	*k.column, *k.last = n, false
+	return nil
+}
+
+// lineLimit is the flag.Value of --head-count and --output-limit, which
+// share one count where -1 means no limit. They differ only at 0:
+// --head-count 0 prints nothing, --output-limit 0 (zeroIsAll) prints all.
+type lineLimit struct {
+	n         *int
+	zeroIsAll bool
+}
+
+func (l lineLimit) String() string {
+	if l.n == nil || *l.n < 0 {
+		return ""
+	}
+	return strconv.Itoa(*l.n)
+}
+
+func (l lineLimit) Set(v string) error {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return fmt.Errorf("want a line count, got %q", v)
+	}
+	if n == 0 && l.zeroIsAll {
+		n = -1
+	}
+	*l.n = n
+	return nil
+}
+
+// stringList is a flag.Value collecting every occurrence of a repeatable
+// string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// optionalValue is a flag.Value for a flag that may be given bare or as
+// --flag=VALUE. Bare, it stores implicit; otherwise VALUE must be one of
+// allowed, or anything when allowed is nil.
+type optionalValue struct {
+	value    *string
+	implicit string
+	allowed  []string
+}
+
+func (v optionalValue) String() string {
+	if v.value == nil {
+		return ""
+	}
+	return *v.value
+}
+
+func (v optionalValue) Set(s string) error {
+	if s == "true" {
+		s = v.implicit
+	}
+	if v.allowed == nil {
+		*v.value = s
+		return nil
+	}
+	for _, a := range v.allowed {
+		if s == a {
+			*v.value = s
+			return nil
+		}
+	}
+	return fmt.Errorf("want one of %s", strings.Join(v.allowed, ", "))
+}
+
+func (v optionalValue) IsBoolFlag() bool { return true }
+
+// extractReplaceArgs removes every "--replace PATTERN REPLACEMENT" triple
+// from args, since the flag package cannot take two values per flag.
+func extractReplaceArgs(args []string) ([]string, []keyReplacement, error) {
+	rest := []string{}
+	reps := []keyReplacement{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		if arg != "--replace" && arg != "-replace" {
+			rest = append(rest, arg)
+			continue
+		}
+		if i+2 >= len(args) {
+			return nil, nil, fmt.Errorf("%s requires PATTERN and REPLACEMENT", arg)
+		}
+		re, err := regexp.Compile(args[i+1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid --replace pattern %q: %v", args[i+1], err)
+		}
+		reps = append(reps, keyReplacement{re: re, repl: args[i+2]})
+		i += 2
+	}
+	return rest, reps, nil
+}
+
+// parseKeySub parses a sed-style --key-sub expression "s/PATTERN/REPL/",
+// optionally followed by g to replace every match. Any character may
+// stand in for '/', and a backslash escapes it inside PATTERN and REPL.
+// PATTERN is a Go regexp; in REPL, & and \1..\9 refer to the match and
+// its groups.
+func parseKeySub(expr string) (keyReplacement, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return keyReplacement{}, fmt.Errorf("invalid --key-sub %q: want s/PATTERN/REPLACEMENT/", expr)
+	}
+	delim := expr[1]
+	parts := []string{}
+	var cur strings.Builder
+	for i := 2; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr) && expr[i+1] == delim:
+			cur.WriteByte(delim)
+			i++
+		case c == '\\' && i+1 < len(expr):
+			cur.WriteByte(c)
+			cur.WriteByte(expr[i+1])
+			i++
+		case c == delim && len(parts) < 2:
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	flags := cur.String()
+	if len(parts) != 2 || (flags != "" && flags != "g") {
+		return keyReplacement{}, fmt.Errorf("invalid --key-sub %q: want s/PATTERN/REPLACEMENT/ with optional g", expr)
+	}
+	re, err := regexp.Compile(parts[0])
+	if err != nil {
+		return keyReplacement{}, fmt.Errorf("invalid --key-sub pattern %q: %v", parts[0], err)
+	}
+	return keyReplacement{re: re, repl: sedReplacement(parts[1]), once: flags != "g"}, nil
+}
+
+// sedReplacement rewrites a sed replacement into regexp.Expand syntax.
+func sedReplacement(repl string) string {
+	var b strings.Builder
+	for i := 0; i < len(repl); i++ {
+		c := repl[i]
+		switch {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '&':
+			b.WriteString("${0}")
+		case c == '\\' && i+1 < len(repl) && repl[i+1] >= '0' && repl[i+1] <= '9':
+			b.WriteString("${" + string(repl[i+1]) + "}")
+			i++
+		case c == '\\' && i+1 < len(repl):
+			b.WriteByte(repl[i+1])
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// permuteArgs moves every flag (and the value of non-boolean flags) in
+// front of the positional arguments, GNU style, so "file -n" means the
+// same as "-n file". Bundled short options such as "-nr" or "-k2" are
+// split up on the way. Everything after "--" is left positional.
+func permuteArgs(fs *flag.FlagSet, args []string) []string {
+	flags := []string{}
+	files := []string{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			files = append(files, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			files = append(files, arg)
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.Contains(name, "=") {
+			flags = append(flags, arg)
+			continue
+		}
+		needsValue := false
+		if f := fs.Lookup(name); f != nil {
+			flags = append(flags, arg)
+			needsValue = !isBoolFlag(f)
+		} else if bundle, pending, ok := splitBundle(fs, arg); ok {
+			flags = append(flags, bundle...)
+			needsValue = pending
+		} else {
+			flags = append(flags, arg)
+		}
+		if needsValue && i+1 < len(args) {
+			flags = append(flags, args[i+1])
+			i++
+		}
+	}
+	return append(append(flags, "--"), files...)
+}
+
+// splitBundle expands a POSIX-style bundle of single-letter options, e.g.
+// "-bnk2" into "-b", "-n", "-k", "2". The first option that takes a value
+// consumes the rest of the bundle as that value; when the bundle ends with
+// it instead, pending reports that the value is the next argument. ok is
+// false when arg is not a valid bundle.
+func splitBundle(fs *flag.FlagSet, arg string) (out []string, pending, ok bool) {
+	if strings.HasPrefix(arg, "--") {
+		return nil, false, false
+	}
+	for i := 1; i < len(arg); i++ {
+		f := fs.Lookup(arg[i : i+1])
+		if f == nil {
+			return nil, false, false
+		}
+		out = append(out, "-"+f.Name)
+		if !isBoolFlag(f) {
+			if i+1 < len(arg) {
+				return append(out, arg[i+1:]), false, true
+			}
+			return out, true, true
+		}
+	}
+	return out, false, true
+}
+
+// isBoolFlag reports whether f can be given without a value.
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
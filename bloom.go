@@ -0,0 +1,85 @@
+package main
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// bloomFilter is a fixed-size Bloom filter using double hashing.
+type bloomFilter struct {
+	bits     []uint64
+	k        int // number of probes per key
+	count    int // keys added
+	capacity int // keys it was sized for
+}
+
+// newBloomFilter sizes a filter for capacity keys at false-positive rate p.
+func newBloomFilter(capacity int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{bits: make([]uint64, int(m)/64+1), k: k, capacity: capacity}
+}
+
+func (f *bloomFilter) probes(h1, h2 uint64, visit func(word int, mask uint64) bool) bool {
+	n := uint64(len(f.bits) * 64)
+	for i := 0; i < f.k; i++ {
+		bit := (h1 + uint64(i)*h2) % n
+		if !visit(int(bit/64), 1<<(bit%64)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) contains(h1, h2 uint64) bool {
+	return f.probes(h1, h2, func(word int, mask uint64) bool { return f.bits[word]&mask != 0 })
+}
+
+func (f *bloomFilter) add(h1, h2 uint64) {
+	f.probes(h1, h2, func(word int, mask uint64) bool {
+		f.bits[word] |= mask
+		return true
+	})
+	f.count++
+}
+
+// scalableBloom is a Bloom filter that grows as keys are added: when the
+// newest filter is full a new one with twice the capacity and half the
+// false-positive rate is started, which keeps the overall rate below the
+// requested one however many keys arrive. It never reports a key that was
+// added as unseen.
+type scalableBloom struct {
+	filters []*bloomFilter
+	rate    float64 // false-positive rate of the newest filter
+	seeds   [2]maphash.Seed
+}
+
+// newScalableBloom returns a filter expecting about capacity keys whose
+// overall false-positive rate stays below p.
+func newScalableBloom(capacity int, p float64) *scalableBloom {
+	b := &scalableBloom{rate: p / 2, seeds: [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()}}
+	b.filters = []*bloomFilter{newBloomFilter(capacity, b.rate)}
+	return b
+}
+
+// seen adds key and reports whether it was (probably) added before.
+func (b *scalableBloom) seen(key string) bool {
+	h1 := maphash.String(b.seeds[0], key)
+	h2 := maphash.String(b.seeds[1], key) | 1
+	for _, f := range b.filters {
+		if f.contains(h1, h2) {
+			return true
+		}
+	}
+	last := b.filters[len(b.filters)-1]
+	if last.count >= last.capacity {
+		b.rate /= 2
+		last = newBloomFilter(last.capacity*2, b.rate)
+		b.filters = append(b.filters, last)
+	}
+	last.add(h1, h2)
+	return false
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// compareFold compares a and b ignoring case, by simple Unicode case
+// mapping of each rune to upper case, as GNU sort -f does, without
+// allocating converted copies.
+func compareFold(a, b string) int {
+	for a != "" && b != "" {
+		ra, sizeA := utf8.DecodeRuneInString(a)
+		rb, sizeB := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			la, lb := unicode.ToUpper(ra), unicode.ToUpper(rb)
+			if la != lb {
+				if la < lb {
+					return -1
+				}
+				return 1
+			}
+		}
+		a, b = a[sizeA:], b[sizeB:]
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+	return 1
+}
+
+// compareAlphabet compares a and b rune by rune using the --alphabet
+// ranks. Characters missing from the alphabet sort after all listed
+// ones, by code point; a string sorts before its extensions.
+func compareAlphabet(a, b string, rank map[rune]int) int {
+	ra, rb := []rune(a), []rune(b)
+	for i := 0; i < len(ra) && i < len(rb); i++ {
+		if ra[i] == rb[i] {
+			continue
+		}
+		pa, okA := rank[ra[i]]
+		pb, okB := rank[rb[i]]
+		if !okA {
+			pa = len(rank) + int(ra[i])
+		}
+		if !okB {
+			pb = len(rank) + int(rb[i])
+		}
+		if pa < pb {
+			return -1
+		}
+		return 1
+	}
+	switch {
+	case len(ra) < len(rb):
+		return -1
+	case len(ra) > len(rb):
+		return 1
+	}
+	return 0
+}
+
+// comparePaths orders '/'-separated paths component by component, each
+// component bytewise, with a path sorting before everything below it.
+// "foo", "foo/a" and "foo-bar" therefore sort in that order, where a plain
+// string comparison would put "foo-bar" first because '-' < '/'. A
+// trailing slash is ignored, and absolute paths, whose first component is
+// empty, sort before relative ones.
+func comparePaths(a, b string) int {
+	a, b = trimPathSlash(a), trimPathSlash(b)
+	for a != "" && b != "" {
+		ca, restA, _ := strings.Cut(a, "/")
+		cb, restB, _ := strings.Cut(b, "/")
+		if c := strings.Compare(ca, cb); c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	return strings.Compare(a, b)
+}
+
+func trimPathSlash(p string) string {
+	if len(p) > 1 {
+		return strings.TrimSuffix(p, "/")
+	}
+	return p
+}
+
+// compareDomains orders host names by their '.'-separated labels from the
+// right, so api.eu.example.com sorts next to db.eu.example.com, and a
+// name sorts before its subdomains. Labels compare case-insensitively and
+// a trailing dot is ignored. IP addresses sort before all names, by
+// address; keys that are equal apart from case fall back to a plain
+// comparison so the order stays deterministic.
+func compareDomains(a, b string) int {
+	if c := compareHosts(a, b); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// compareHosts is compareDomains without the final tie-break: names that
+// differ only in case or a trailing dot compare equal.
+func compareHosts(a, b string) int {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	switch {
+	case ipA != nil && ipB != nil:
+		return bytes.Compare(ipA.To16(), ipB.To16())
+	case ipA != nil:
+		return -1
+	case ipB != nil:
+		return 1
+	}
+	labelsA := strings.Split(strings.ToLower(strings.TrimSuffix(a, ".")), ".")
+	labelsB := strings.Split(strings.ToLower(strings.TrimSuffix(b, ".")), ".")
+	for i, j := len(labelsA)-1, len(labelsB)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(labelsA[i], labelsB[j]); c != 0 {
+			return c
+		}
+	}
+	if len(labelsA) != len(labelsB) {
+		if len(labelsA) < len(labelsB) {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// compareEmails orders addresses by domain, using the --domain rules,
+// then by local part. The domain is everything after the last '@' and is
+// case-insensitive; the local part is case-sensitive, as RFC 5321 allows
+// it to be. Keys without an '@' sort after all addresses, among
+// themselves as plain strings.
+func compareEmails(a, b string) int {
+	atA, atB := strings.LastIndexByte(a, '@'), strings.LastIndexByte(b, '@')
+	switch {
+	case atA < 0 && atB < 0:
+		return strings.Compare(a, b)
+	case atA < 0:
+		return 1
+	case atB < 0:
+		return -1
+	}
+	if c := compareHosts(a[atA+1:], b[atB+1:]); c != 0 {
+		return c
+	}
+	return strings.Compare(a[:atA], b[:atB])
+}
+
+// compareURLs orders URLs by host, using the --domain rules, then by path
+// with the --paths rules, then by query string. A key without a scheme is
+// read as http. Keys that do not parse as a URL with a host sort after
+// all URLs, among themselves as plain strings. Scheme, user info and
+// fragment are ignored unless the URLs are otherwise equal and normalize
+// is false, in which case the whole keys decide.
+func compareURLs(a, b string, normalize bool) int {
+	ua, ub := parseURLKey(a), parseURLKey(b)
+	switch {
+	case ua == nil && ub == nil:
+		return strings.Compare(a, b)
+	case ua == nil:
+		return 1
+	case ub == nil:
+		return -1
+	}
+	if c := compareHosts(ua.Hostname(), ub.Hostname()); c != 0 {
+		return c
+	}
+	if c := strings.Compare(ua.Port(), ub.Port()); c != 0 {
+		return c
+	}
+	if c := comparePaths(urlPath(ua), urlPath(ub)); c != 0 {
+		return c
+	}
+	if c := strings.Compare(ua.RawQuery, ub.RawQuery); c != 0 || normalize {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// parseURLKey parses a --url key, or returns nil if it has no host.
+func parseURLKey(key string) *url.URL {
+	if !strings.Contains(key, "://") {
+		key = "http://" + key
+	}
+	u, err := url.Parse(key)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return u
+}
+
+// urlPath is the path of u, with an empty path read as "/".
+func urlPath(u *url.URL) string {
+	if u.Path == "" {
+		return "/"
+	}
+	return u.Path
+}
+
+// computeEntropy returns the Shannon entropy of the byte distribution of
+// s in bits: H = -sum(p_i * log2(p_i)). An empty string has entropy 0.
+func computeEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	h := 0.0
+	n := float64(len(s))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// compareEntropy orders keys by computeEntropy, lowest first, and keys
+// of equal entropy as plain strings.
+func compareEntropy(a, b string) int {
+	ha, hb := computeEntropy(a), computeEntropy(b)
+	switch {
+	case ha < hb:
+		return -1
+	case ha > hb:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// parseUUID reads a UUID in any letter case, with or without hyphens and
+// surrounding braces.
+func parseUUID(s string) ([16]byte, bool) {
+	var u [16]byte
+	if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+		s = s[1 : len(s)-1]
+	}
+	if len(s) == 36 {
+		if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+			return u, false
+		}
+		s = s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+	}
+	if len(s) != 32 {
+		return u, false
+	}
+	if _, err := hex.Decode(u[:], []byte(s)); err != nil {
+		return u, false
+	}
+	return u, true
+}
+
+// uuidTime returns the embedded timestamp of a version 1 or 7 UUID in
+// 100ns units since the Unix epoch.
+func uuidTime(u [16]byte) (int64, bool) {
+	switch u[6] >> 4 {
+	case 1:
+		ts := int64(u[6]&0x0f)<<56 | int64(u[7])<<48 | int64(u[4])<<40 | int64(u[5])<<32 |
+			int64(u[0])<<24 | int64(u[1])<<16 | int64(u[2])<<8 | int64(u[3])
+		const gregorianToUnix = 0x01b21dd213814000
+		return ts - gregorianToUnix, true
+	case 7:
+		ms := int64(u[0])<<40 | int64(u[1])<<32 | int64(u[2])<<24 | int64(u[3])<<16 | int64(u[4])<<8 | int64(u[5])
+		return ms * 10000, true
+	}
+	return 0, false
+}
+
+// compareUUIDs orders UUIDs by their 128-bit value, so differently
+// written forms of one UUID compare equal. With byTime, version 1 and 7
+// UUIDs come first, ordered by timestamp, followed by the other versions.
+// Keys that are no UUID sort after all UUIDs, as plain strings.
+func compareUUIDs(a, b string, byTime bool) int {
+	ua, okA := parseUUID(a)
+	ub, okB := parseUUID(b)
+	switch {
+	case !okA && !okB:
+		return strings.Compare(a, b)
+	case !okA:
+		return 1
+	case !okB:
+		return -1
+	}
+	if byTime {
+		ta, timedA := uuidTime(ua)
+		tb, timedB := uuidTime(ub)
+		switch {
+		case timedA && !timedB:
+			return -1
+		case !timedA && timedB:
+			return 1
+		case ta < tb:
+			return -1
+		case ta > tb:
+			return 1
+		}
+	}
+	return bytes.Compare(ua[:], ub[:])
+}
+
+// levenshtein returns the edit distance between a and b: the fewest
+// single-rune insertions, deletions and substitutions turning a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// compareDistance orders keys by their levenshtein distance from ref,
+// nearest first, and keys at equal distance as plain strings.
+func compareDistance(a, b, ref string) int {
+	if cmp := cmpInt(levenshtein(a, ref), levenshtein(b, ref)); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(a, b)
+}
+
+// jaroWinkler returns the Jaro-Winkler similarity of a and b, from 0 for
+// nothing in common to 1 for equal strings. Runes match within half the
+// longer length, less one; a common prefix of up to four runes raises
+// the Jaro score with the usual scaling factor 0.1.
+func jaroWinkler(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) == 0 && len(rb) == 0 {
+		return 1
+	}
+	if len(ra) == 0 || len(rb) == 0 {
+		return 0
+	}
+	window := max(max(len(ra), len(rb))/2-1, 0)
+	matchedA := make([]bool, len(ra))
+	matchedB := make([]bool, len(rb))
+	matches := 0
+	for i, r := range ra {
+		for j := max(0, i-window); j < min(len(rb), i+window+1); j++ {
+			if !matchedB[j] && rb[j] == r {
+				matchedA[i], matchedB[j] = true, true
+				matches++
+				break
+			}
+		}
+	}
+	if matches == 0 {
+		return 0
+	}
+	// Transpositions: matched runes that are out of order, halved.
+	halfSwaps, j := 0, 0
+	for i, r := range ra {
+		if !matchedA[i] {
+			continue
+		}
+		for !matchedB[j] {
+			j++
+		}
+		if rb[j] != r {
+			halfSwaps++
+		}
+		j++
+	}
+	m := float64(matches)
+	jaro := (m/float64(len(ra)) + m/float64(len(rb)) + (m-float64(halfSwaps)/2)/m) / 3
+	prefix := 0
+	for prefix < min(4, len(ra), len(rb)) && ra[prefix] == rb[prefix] {
+		prefix++
+	}
+	return jaro + float64(prefix)*0.1*(1-jaro)
+}
+
+// compareJaroWinkler orders keys by their jaroWinkler similarity to ref,
+// most similar first, and equally similar keys as plain strings.
+func compareJaroWinkler(a, b, ref string) int {
+	if cmp := cmpFloat(1-jaroWinkler(a, ref), 1-jaroWinkler(b, ref)); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(a, b)
+}
+
+// splitNumericPrefix splits key into its leading integer, with an
+// optional sign, and the rest. A key without leading digits is 0 with the
+// whole key as the rest; a prefix too large for int64 is clamped.
+func splitNumericPrefix(key string) (int64, string) {
+	i := 0
+	if i < len(key) && (key[i] == '-' || key[i] == '+') {
+		i++
+	}
+	end := i
+	for end < len(key) && key[end] >= '0' && key[end] <= '9' {
+		end++
+	}
+	if end == i {
+		return 0, key
+	}
+	// On overflow ParseInt still returns the nearest int64.
+	n, _ := strconv.ParseInt(key[:end], 10, 64)
+	return n, key[end:]
+}
+
+// compareNumericPrefix orders keys by their leading integer, then by the
+// text after it, so "3rd" sorts before "10 items" and "10 apples" before
+// "10 items".
+func compareNumericPrefix(a, b string) int {
+	na, restA := splitNumericPrefix(a)
+	nb, restB := splitNumericPrefix(b)
+	switch {
+	case na < nb:
+		return -1
+	case na > nb:
+		return 1
+	}
+	if cmp := strings.Compare(restA, restB); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(a, b)
+}
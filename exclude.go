@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"sort"
+)
+
+// keySet is the --exclude-file or --include-file set: the keys of
+// another file's lines, sorted so that membership is a binary search
+// under the sorter's own comparison. The whole file is held in memory.
+type keySet struct {
+	sorter byKey
+	keys   []string
+}
+
+// loadKeySet reads the key file name. Its lines are bare keys: the
+// key options that pick part of a line are not applied to them, but the
+// ones that transform keys (--key-sub, --key-map, -b and so on) are, so
+// both sides are compared alike.
+func loadKeySet(name string, sorter byKey, delim byte) (*keySet, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sorter.extractor = nil
+	set := &keySet{sorter: sorter}
+	scanner := newLineScanner(f, delim)
+	for scanner.Scan() {
+		set.keys = append(set.keys, sorter.comparedKey(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(set.keys, func(i, j int) bool { return sorter.compareKeys(set.keys[i], set.keys[j]) < 0 })
+	return set, nil
+}
+
+// contains reports whether key equals one of the set's keys. Under -n, -h
+// and -M equal values count, as they do for -u; spellings of one value
+// sort next to each other, so only the neighbours of the search position
+// need a look.
+func (ks *keySet) contains(key string) bool {
+	s := ks.sorter
+	i := sort.Search(len(ks.keys), func(i int) bool { return s.compareKeys(ks.keys[i], key) >= 0 })
+	same := func(other string) bool { return s.compareKeys(other, key) == 0 }
+	if s.numeric || s.human || s.month {
+		same = func(other string) bool { return s.sameValue(other, key) }
+	}
+	return i < len(ks.keys) && same(ks.keys[i]) || i > 0 && same(ks.keys[i-1])
+}
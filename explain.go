@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// explainOrder writes one sentence per adjacent pair of sorted lines
+// saying why the first comes before the second, for at most limit pairs
+// (0 means all). order holds the 0-based input position of each line.
+func explainOrder(w io.Writer, sorter byKey, lines []string, order []int, limit int) {
+	mode := sorter.modeName()
+	for i := 1; i < len(lines); i++ {
+		if limit > 0 && i > limit {
+			break
+		}
+		a, b := sorter.comparedKey(lines[i-1]), sorter.comparedKey(lines[i])
+		cmp := sorter.compareKeys(a, b)
+		first, second := order[i-1]+1, order[i]+1
+		switch {
+		case cmp == 0 && sorter.stableOutput:
+			fmt.Fprintf(w, "Line %d before line %d because keys '%s' and '%s' are equal (%s) and the whole lines compare in that order\n", first, second, a, b, mode)
+		case cmp == 0 && sorter.preserveOrder:
+			fmt.Fprintf(w, "Line %d before line %d because keys '%s' and '%s' are equal (%s), so input order is kept\n", first, second, a, b, mode)
+		case cmp == 0:
+			fmt.Fprintf(w, "Line %d before line %d because keys '%s' and '%s' are equal (%s); the order of equal keys is unspecified\n", first, second, a, b, mode)
+		case cmp < 0:
+			fmt.Fprintf(w, "Line %d before line %d because key '%s' < '%s' (%s)\n", first, second, a, b, mode)
+		default:
+			fmt.Fprintf(w, "Line %d before line %d because key '%s' > '%s' (%s, reversed)\n", first, second, a, b, mode)
+		}
+	}
+}
+
+// modeName describes the active comparison for --explain.
+func (s byKey) modeName() string {
+	switch {
+	case s.bytewise:
+		return "byte comparison"
+	case s.human:
+		return "human-numeric comparison"
+	case s.numeric:
+		return "numeric comparison"
+	case s.monthYear:
+		return "year and month comparison"
+	case s.month:
+		return "month comparison"
+	case s.paths:
+		return "path comparison"
+	case s.alphabet != nil:
+		return "alphabet comparison"
+	case s.foldExact:
+		return "case-insensitive comparison, then exact"
+	case s.fold:
+		return "case-insensitive comparison"
+	case s.domains:
+		return "domain comparison"
+	case s.emails:
+		return "email comparison"
+	case s.uuids != "":
+		return "UUID comparison"
+	case s.entropy:
+		return "entropy comparison"
+	case s.distanceRef != "":
+		return "edit distance comparison"
+	case s.numericPrefix:
+		return "numeric prefix comparison"
+	case s.similarRef != "":
+		return "Jaro-Winkler similarity comparison"
+	case s.urls != "":
+		return "URL comparison"
+	}
+	return "string comparison"
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expr is a parsed --field-compute expression. eval reports false when
+// the value is undefined: a referenced field is missing or not a number,
+// or a division by zero.
+type expr interface {
+	eval(fields []string) (float64, bool)
+}
+
+type numberExpr float64
+
+func (e numberExpr) eval([]string) (float64, bool) { return float64(e), true }
+
+// fieldExpr is a $N reference to the 1-based field N.
+type fieldExpr int
+
+func (e fieldExpr) eval(fields []string) (float64, bool) {
+	if int(e) > len(fields) {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(fields[e-1]), 64)
+	return v, err == nil
+}
+
+type negExpr struct{ x expr }
+
+func (e negExpr) eval(fields []string) (float64, bool) {
+	v, ok := e.x.eval(fields)
+	return -v, ok
+}
+
+type binaryExpr struct {
+	op   byte
+	l, r expr
+}
+
+func (e binaryExpr) eval(fields []string) (float64, bool) {
+	l, ok := e.l.eval(fields)
+	if !ok {
+		return 0, false
+	}
+	r, ok := e.r.eval(fields)
+	if !ok {
+		return 0, false
+	}
+	switch e.op {
+	case '+':
+		return l + r, true
+	case '-':
+		return l - r, true
+	case '*':
+		return l * r, true
+	}
+	if r == 0 {
+		return 0, false
+	}
+	return l / r, true
+}
+
+// parseExpr parses an arithmetic expression over field references $N and
+// numbers, with + - * /, unary minus and parentheses.
+func parseExpr(s string) (expr, error) {
+	p := &exprParser{src: s}
+	e, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[p.pos], p.pos)
+	}
+	return e, nil
+}
+
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// peek returns the next non-blank byte, or 0 at the end.
+func (p *exprParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.src) {
+		return p.src[p.pos]
+	}
+	return 0
+}
+
+func (p *exprParser) sum() (expr, error) {
+	l, err := p.product()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '+' || op == '-'; op = p.peek() {
+		p.pos++
+		r, err := p.product()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) product() (expr, error) {
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for op := p.peek(); op == '*' || op == '/'; op = p.peek() {
+		p.pos++
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = binaryExpr{op, l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) unary() (expr, error) {
+	switch p.peek() {
+	case '-':
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return negExpr{x}, nil
+	case '(':
+		p.pos++
+		e, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return e, nil
+	case '$':
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.src) && p.src[p.pos] >= '0' && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		n, err := strconv.Atoi(p.src[start:p.pos])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad field reference at offset %d", start-1)
+		}
+		return fieldExpr(n), nil
+	case 0:
+		return nil, errors.New("unexpected end of expression")
+	}
+	start := p.pos
+	for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+		p.pos++
+	}
+	v, err := strconv.ParseFloat(p.src[start:p.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.src[start], start)
+	}
+	return numberExpr(v), nil
+}
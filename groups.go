@@ -0,0 +1,32 @@
+package main
+
+// sortGroups partitions lines by the key group extracts, sorts each
+// partition with sortIndexed and concatenates the partitions in the order
+// their first line appeared in the input. Deduplication applies within a
+// partition. The returned positions refer to lines, like sortIndexed's.
+func (s byKey) sortGroups(lines []string, group keyExtractor, dedup dedupConfig) ([]string, []int) {
+	buckets := make(map[string][]int)
+	var groups []string
+	for i, line := range lines {
+		g := group.key(line)
+		if _, ok := buckets[g]; !ok {
+			groups = append(groups, g)
+		}
+		buckets[g] = append(buckets[g], i)
+	}
+	sorted := make([]string, 0, len(lines))
+	order := make([]int, 0, len(lines))
+	for _, g := range groups {
+		members := buckets[g]
+		bucket := make([]string, len(members))
+		for i, idx := range members {
+			bucket[i] = lines[idx]
+		}
+		bucketSorted, bucketOrder := s.sortIndexed(bucket, dedup)
+		sorted = append(sorted, bucketSorted...)
+		for _, idx := range bucketOrder {
+			order = append(order, members[idx])
+		}
+	}
+	return sorted, order
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// expandGlobs returns the positional file names followed by the matches
+// of each pattern, every pattern's matches in sorted order. A pattern
+// without matches is an error unless warn is set, in which case a warning
+// is printed to stderr. With no names at all, stdin ("-") is used.
+func expandGlobs(names []string, patterns []string, warn bool, stderr io.Writer) ([]string, error) {
+	out := append([]string{}, names...)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			if !warn {
+				return nil, fmt.Errorf("no files match %q", pattern)
+			}
+			fmt.Fprintf(stderr, "Warning: no files match %q\n", pattern)
+			continue
+		}
+		sort.Strings(matches)
+		out = append(out, matches...)
+	}
+	if len(out) == 0 && len(patterns) == 0 {
+		out = append(out, "-")
+	}
+	return out, nil
+}
+
+// openInputs opens the named inputs, "-" meaning stdin and names
+// starting with http:// or https:// being fetched with openURL. The
+// returned function closes every file and response body that was opened.
+func openInputs(names []string, stdin io.Reader, timeout time.Duration) ([]io.Reader, func(), error) {
+	files := []io.Closer{}
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	readers := []io.Reader{}
+	for _, name := range names {
+		if name == "-" {
+			readers = append(readers, stdin)
+			continue
+		}
+		if isURL(name) {
+			body, r, err := openURL(name, timeout)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			files = append(files, body)
+			readers = append(readers, r)
+			continue
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	return readers, closeAll, nil
+}
+
+// isURL reports whether an input name is fetched over HTTP.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openURL starts a GET request for url and returns the response body to
+// close and the reader to take lines from. Redirects are followed, a
+// status outside 2xx is an error, and a gzip Content-Encoding that the
+// transport did not already undo is decompressed. A positive timeout
+// bounds the whole request, including reading the body.
+func openURL(url string, timeout time.Duration) (io.Closer, io.Reader, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%s: %v", url, err)
+		}
+		return resp.Body, zr, nil
+	}
+	return resp.Body, resp.Body, nil
+}
+
+// readHeader returns the first count lines of the named file, or all of
+// them when count is 0, for --header-file.
+func readHeader(name string, count int, delim byte) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := []string{}
+	scanner := newLineScanner(f, delim)
+	for (count == 0 || len(header) < count) && scanner.Scan() {
+		header = append(header, scanner.Text())
+	}
+	return header, scanner.Err()
+}
+
+// loadOrderFile reads an --order-file: one key per line, ranked by
+// position. Blank lines and lines starting with '#' are skipped, and a
+// key listed twice keeps its first rank.
+func loadOrderFile(name string) (map[string]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rank := map[string]int{}
+	scanner := newLineScanner(f, '\n')
+	for scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key == "" || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if _, ok := rank[key]; !ok {
+			rank[key] = len(rank)
+		}
+	}
+	return rank, scanner.Err()
+}
+
+// loadAlphabet reads an --alphabet file and ranks every character it
+// lists: characters are ranked in the order they appear, line by line,
+// and a line of the form "X-Y" stands for the whole range X through Y.
+// Blank lines are skipped and a character listed twice keeps its first
+// rank.
+func loadAlphabet(name string) (map[rune]int, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	rank := map[rune]int{}
+	add := func(r rune) {
+		if _, ok := rank[r]; !ok {
+			rank[r] = len(rank)
+		}
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		runes := []rune(strings.TrimRight(line, "\r"))
+		if len(runes) == 3 && runes[1] == '-' {
+			if runes[0] > runes[2] {
+				return nil, fmt.Errorf("%s: invalid range %q", name, string(runes))
+			}
+			for r := runes[0]; r <= runes[2]; r++ {
+				add(r)
+			}
+			continue
+		}
+		for _, r := range runes {
+			add(r)
+		}
+	}
+	return rank, nil
+}
+
+// concatInputs joins readers into a single stream, making sure every
+// input ends with the record delimiter so the last line of one file is
+// not glued to the first line of the next.
+func concatInputs(readers []io.Reader, delim byte) io.Reader {
+	if len(readers) == 1 {
+		return readers[0]
+	}
+	wrapped := make([]io.Reader, len(readers))
+	for i, r := range readers {
+		wrapped[i] = &lineTerminatedReader{r: r, delim: delim}
+	}
+	return io.MultiReader(wrapped...)
+}
+
+// maxLineLength is the longest line the scanners accept.
+const maxLineLength = 1 << 30
+
+// newLineScanner returns a scanner splitting r into records ending with
+// delim. Newline-terminated input keeps bufio.ScanLines semantics, which
+// also drop a trailing carriage return.
+func newLineScanner(r io.Reader, delim byte) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineLength)
+	if delim != '\n' {
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			if atEOF && len(data) == 0 {
+				return 0, nil, nil
+			}
+			if i := bytes.IndexByte(data, delim); i >= 0 {
+				return i + 1, data[:i], nil
+			}
+			if atEOF {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		})
+	}
+	return scanner
+}
+
+// lineTerminatedReader passes r through and adds a final delimiter when
+// the data is non-empty and does not end with one.
+type lineTerminatedReader struct {
+	r     io.Reader
+	delim byte
+	last  byte
+	seen  bool
+	done  bool
+}
+
+func (t *lineTerminatedReader) Read(p []byte) (int, error) {
+	if t.done {
+		return 0, io.EOF
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.seen = true
+		t.last = p[n-1]
+		if err == io.EOF {
+			err = nil
+		}
+		return n, err
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	t.done = true
+	if t.seen && t.last != t.delim && len(p) > 0 {
+		p[0] = t.delim
+		return 1, nil
+	}
+	return 0, io.EOF
+}
+
+// detectEncoding looks for a byte order mark at the start of r. A UTF-8
+// BOM is dropped; a UTF-16 BOM is dropped and the rest of the stream is
+// decoded to UTF-8. Without a BOM the data passes through unchanged.
+func detectEncoding(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}):
+		br.Discard(3)
+		return br
+	case bytes.HasPrefix(head, []byte{0xFF, 0xFE}):
+		br.Discard(2)
+		return &utf16Reader{r: br, order: binary.LittleEndian}
+	case bytes.HasPrefix(head, []byte{0xFE, 0xFF}):
+		br.Discard(2)
+		return &utf16Reader{r: br, order: binary.BigEndian}
+	}
+	return br
+}
+
+// utf16Reader decodes a UTF-16 stream into UTF-8. Unpaired surrogates
+// and a trailing odd byte turn into U+FFFD.
+type utf16Reader struct {
+	r     *bufio.Reader
+	order binary.ByteOrder
+	out   []byte // decoded bytes not yet returned
+	err   error
+}
+
+func (u *utf16Reader) Read(p []byte) (int, error) {
+	for len(u.out) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		u.fill()
+	}
+	n := copy(p, u.out)
+	u.out = u.out[n:]
+	return n, nil
+}
+
+// fill decodes the next batch of code units into u.out.
+func (u *utf16Reader) fill() {
+	for i := 0; i < 1024 && u.err == nil; i++ {
+		c, ok := u.unit()
+		if !ok {
+			return
+		}
+		if utf16.IsSurrogate(c) {
+			c2, ok := u.unit()
+			if !ok {
+				u.out = utf8.AppendRune(u.out, utf8.RuneError)
+				return
+			}
+			if r := utf16.DecodeRune(c, c2); r != utf8.RuneError {
+				c = r
+			} else {
+				u.out = utf8.AppendRune(u.out, utf8.RuneError)
+				c = c2
+				if utf16.IsSurrogate(c) {
+					c = utf8.RuneError
+				}
+			}
+		}
+		u.out = utf8.AppendRune(u.out, c)
+	}
+}
+
+// unit reads one code unit, recording the error at the end of the data.
+func (u *utf16Reader) unit() (rune, bool) {
+	var b [2]byte
+	_, err := io.ReadFull(u.r, b[:])
+	if err == io.ErrUnexpectedEOF {
+		u.out = utf8.AppendRune(u.out, utf8.RuneError)
+		err = io.EOF
+	}
+	if err != nil {
+		u.err = err
+		return 0, false
+	}
+	return rune(u.order.Uint16(b[:])), true
+}
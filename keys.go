@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/adler32"
+	"hash/crc32"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// keyExtractor selects the part of a line that is compared. Extractors
+// must be pure functions of the line: they are called repeatedly for the
+// same line during a sort and must not keep state between calls.
+type keyExtractor interface {
+	key(line string) string
+}
+
+// fieldKey is the -k extractor: the 1-based field column of the line.
+type fieldKey struct {
+	column    int
+	separator string
+	quote     byte // --field-quote-char, or 0
+}
+
+func (k fieldKey) key(line string) string {
+	fields := splitFields(line, k.separator, k.quote)
+	if k.column-1 >= len(fields) {
+		return ""
+	}
+	return fields[k.column-1]
+}
+
+// lastFieldKey selects the final field of each line, however many fields
+// that line has.
+type lastFieldKey struct {
+	separator string
+	quote     byte
+}
+
+func (k lastFieldKey) key(line string) string {
+	fields := splitFields(line, k.separator, k.quote)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// splitFields splits a line on the -t separator. A single space splits on
+// runs of blanks and an empty separator splits into single characters.
+// A non-zero quote is the --field-quote-char; see splitQuoted.
+func splitFields(line, separator string, quote byte) []string {
+	if quote != 0 {
+		return splitQuoted(line, separator, quote)
+	}
+	if separator == " " {
+		return strings.Fields(line)
+	}
+	return strings.Split(line, separator)
+}
+
+// splitQuoted is splitFields for --field-quote-char: a field starting
+// with quote runs to the next quote not escaped by a backslash, so it may
+// contain the separator. The quotes stay part of the field, so rejoining
+// the fields gives back the line.
+func splitQuoted(line, separator string, quote byte) []string {
+	blanks := separator == " "
+	fields := []string{}
+	i := 0
+	for {
+		if blanks {
+			skip := strings.IndexFunc(line[i:], func(r rune) bool { return !unicode.IsSpace(r) })
+			if skip < 0 {
+				return fields
+			}
+			i += skip
+		}
+		start := i
+		if i < len(line) && line[i] == quote {
+			for i++; i < len(line) && line[i] != quote; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			i = min(i+1, len(line))
+		}
+		var end int
+		if blanks {
+			end = strings.IndexFunc(line[i:], unicode.IsSpace)
+		} else {
+			end = strings.Index(line[i:], separator)
+		}
+		if end < 0 {
+			return append(fields, line[start:])
+		}
+		fields = append(fields, line[start:i+end])
+		i += end
+		if !blanks {
+			i += len(separator)
+		}
+	}
+}
+
+// charRangeKey is the --column-range extractor: characters start..end
+// (1-based, inclusive), clamped to the line length.
+type charRangeKey struct {
+	start int
+	end   int
+}
+
+func (k charRangeKey) key(line string) string {
+	if k.start > len(line) {
+		return ""
+	}
+	end := k.end
+	if end > len(line) {
+		end = len(line)
+	}
+	return line[k.start-1 : end]
+}
+
+// byteRangeKey is the --byte-offset/--byte-length extractor.
+type byteRangeKey struct {
+	offset int
+	length int
+}
+
+func (k byteRangeKey) key(line string) string {
+	if k.offset >= len(line) {
+		return ""
+	}
+	end := k.offset + k.length
+	if end > len(line) {
+		end = len(line)
+	}
+	return line[k.offset:end]
+}
+
+// parseColumnRange parses a --column-range value of the form START,END.
+func parseColumnRange(spec string) (int, int, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid --column-range %q: want START,END", spec)
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --column-range start %q", parts[0])
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid --column-range end %q", parts[1])
+	}
+	if start < 1 || end < start {
+		return 0, 0, fmt.Errorf("invalid --column-range %q: need 1 <= START <= END", spec)
+	}
+	return start, end, nil
+}
+
+// numberPattern matches a number embedded in free text: an optional sign,
+// digits and an optional decimal part.
+var numberPattern = regexp.MustCompile(`[-+]?[0-9]+(\.[0-9]+)?`)
+
+// numberKey is the --extract-number extractor: the index-th number found
+// in the key of inner (the whole line when inner is nil), counting from 1,
+// or from the end when index is negative. Keys with no such number are
+// empty.
+type numberKey struct {
+	inner keyExtractor
+	index int
+}
+
+func (k numberKey) key(line string) string {
+	if k.inner != nil {
+		line = k.inner.key(line)
+	}
+	if k.index > 0 {
+		numbers := numberPattern.FindAllString(line, k.index)
+		if len(numbers) < k.index {
+			return ""
+		}
+		return numbers[k.index-1]
+	}
+	numbers := numberPattern.FindAllString(line, -1)
+	if len(numbers) < -k.index {
+		return ""
+	}
+	return numbers[len(numbers)+k.index]
+}
+
+// computedKey is the --field-compute extractor: the value of an
+// arithmetic expression over the line's fields, formatted for -n.
+// Lines where the value is undefined get an empty key.
+type computedKey struct {
+	expr      expr
+	separator string
+	quote     byte
+}
+
+func (k computedKey) key(line string) string {
+	v, ok := k.expr.eval(splitFields(line, k.separator, k.quote))
+	if !ok {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// checksumKey is the --by-checksum extractor: the hex digest of the key
+// of inner (the whole line when inner is nil). Digests of one algorithm
+// have a fixed width, so comparing them as strings orders them by value.
+type checksumKey struct {
+	inner   keyExtractor
+	newHash func() hash.Hash
+}
+
+// newChecksumKey returns the extractor for algorithm algo. poly selects
+// the CRC32 polynomial, 0 meaning IEEE; other algorithms take no
+// polynomial.
+func newChecksumKey(inner keyExtractor, algo string, poly uint32) (checksumKey, error) {
+	if poly != 0 && algo != "crc32" {
+		return checksumKey{}, fmt.Errorf("--checksum-seed only applies to crc32, not %s", algo)
+	}
+	k := checksumKey{inner: inner}
+	switch algo {
+	case "crc32":
+		if poly == 0 {
+			poly = crc32.IEEE
+		}
+		table := crc32.MakeTable(poly)
+		k.newHash = func() hash.Hash { return crc32.New(table) }
+	case "adler32":
+		k.newHash = func() hash.Hash { return adler32.New() }
+	case "sha1":
+		k.newHash = sha1.New
+	case "md5":
+		k.newHash = md5.New
+	default:
+		return checksumKey{}, fmt.Errorf("invalid --by-checksum %q: want crc32, adler32, sha1 or md5", algo)
+	}
+	return k, nil
+}
+
+func (k checksumKey) key(line string) string {
+	if k.inner != nil {
+		line = k.inner.key(line)
+	}
+	h := k.newHash()
+	h.Write([]byte(line))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// keyTransforms are the --key-map and --key-transform steps by name. Each
+// is a pure function of the key.
+var keyTransforms = map[string]func(string) string{
+	"lower":          strings.ToLower,
+	"upper":          strings.ToUpper,
+	"title":          titleCase,
+	"trim":           strings.TrimSpace,
+	"squeeze":        squeezeBlanks,
+	"reverse-string": reverseRunes,
+	"base64-encode": func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	},
+	"strip-punct": func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsPunct(r) {
+				return -1
+			}
+			return r
+		}, s)
+	},
+}
+
+// titleCase upper-cases the first letter of every word and lower-cases
+// the rest.
+func titleCase(s string) string {
+	var b strings.Builder
+	inWord := false
+	for _, r := range s {
+		if inWord {
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(unicode.ToUpper(r))
+		}
+		inWord = unicode.IsLetter(r) || unicode.IsDigit(r)
+	}
+	return b.String()
+}
+
+// reverseRunes returns s with its runes in reverse order.
+func reverseRunes(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+// parseKeyTransforms looks up the named keyTransforms, in order; flagName
+// is the option they came from, for the error.
+func parseKeyTransforms(flagName string, names []string) ([]func(string) string, error) {
+	steps := []func(string) string{}
+	for _, name := range names {
+		step, ok := keyTransforms[strings.TrimSpace(name)]
+		if !ok {
+			known := make([]string, 0, len(keyTransforms))
+			for n := range keyTransforms {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("%s: unknown transform %q, want one of %s", flagName, name, strings.Join(known, ", "))
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
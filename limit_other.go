@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// defaultMergeLimit is the --merge-limit default. Without an open file
+// limit to consult it is always 100 inputs.
+func defaultMergeLimit() int {
+	return 100
+}
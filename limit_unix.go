@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// defaultMergeLimit is the --merge-limit default: 100 inputs, or half the
+// open file limit when that is lower.
+func defaultMergeLimit() int {
+	limit := 100
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err == nil && rl.Cur/2 < uint64(limit) {
+		limit = int(rl.Cur / 2)
+	}
+	if limit < 2 {
+		limit = 2
+	}
+	return limit
+}
@@ -2,15 +2,25 @@ package main
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/maphash"
 	"io"
 	"log"
 	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // monthMap maps month abbreviations to their numerical values.
@@ -19,6 +29,13 @@ var monthMap = map[string]int{
 	"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
 }
 
+// monthNames are the full month names that --strict-month accepts, along
+// with their abbreviations.
+var monthNames = []string{
+	"JANUARY", "FEBRUARY", "MARCH", "APRIL", "MAY", "JUNE",
+	"JULY", "AUGUST", "SEPTEMBER", "OCTOBER", "NOVEMBER", "DECEMBER",
+}
+
 // numVal represents a parsed numeric value for -n sort.
 type numVal struct {
 	sign     int
@@ -40,49 +57,212 @@ type monthVal struct {
 	raw   string
 }
 
+// keyReplacement is a regexp substitution applied to extracted keys.
+type keyReplacement struct {
+	re   *regexp.Regexp
+	repl string
+	once bool // replace only the first match, as sed without the g flag
+}
+
 // byKey implements sort.Interface for sorting lines based on keys.
 type byKey struct {
-	lines   []string
-	column  int
-	numeric bool
-	human   bool
-	month   bool
-	blanks  bool
-	reverse bool
+	lines         []string
+	keys          []string // precomputed getKey of each line, or nil
+	order         []int    // input position of each line, swapped along with keys
+	extractor     keyExtractor
+	bytewise      bool
+	stableOutput  bool // break key ties by comparing whole lines
+	preserveOrder bool // sort with sort.Stable, keeping ties in input order
+	squeezeBlanks bool // --unique-normalized: compare keys with blanks squeezed
+	numeric       bool
+	human         bool
+	month         bool
+	paths         bool                  // compare keys as '/'-separated paths
+	domains       bool                  // compare keys as host names, top-level label first
+	emails        bool                  // compare keys as addresses, domain first
+	urls          string                // --url mode: "", "plain" or "normalize"
+	entropy       bool                  // compare keys by Shannon entropy of their bytes
+	distanceRef   string                // --by-distance reference, or ""
+	similarRef    string                // --by-jaro-winkler reference, or ""
+	numericPrefix bool                  // compare the leading integer, then the rest
+	uuids         string                // --uuid mode: "", "value" or "time"
+	rank          map[string]int        // --order-file position of listed keys, or nil
+	alphabet      map[rune]int          // --alphabet position of listed characters, or nil
+	fold          bool                  // -f: compare keys ignoring case
+	foldExact     bool                  // with fold, break ties by exact bytes
+	keyLimit      int                   // --key-length-limit in runes, 0 for none
+	monthYear     bool                  // with month, compare a following year first
+	keyMap        []func(string) string // --key-map steps, applied in order
+	blanks        bool
+	reverse       bool
+	replacements  []keyReplacement
+	stats         *sortStats
+}
+
+// sortStats collects the figures printed by --output-stats.
+type sortStats struct {
+	linesRead    int
+	linesWritten int
+	linesKept    int // lines left by -u, for --report-unique
+	linesRemoved int
+	sortTime     time.Duration
+	comparisons  int
+}
+
+// print writes the statistics in human-readable form.
+func (st *sortStats) print(w io.Writer) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Fprintf(w, "lines read:    %d\n", st.linesRead)
+	fmt.Fprintf(w, "lines written: %d\n", st.linesWritten)
+	fmt.Fprintf(w, "lines removed: %d\n", st.linesRemoved)
+	fmt.Fprintf(w, "sort time:     %v\n", st.sortTime)
+	fmt.Fprintf(w, "comparisons:   %d\n", st.comparisons)
+	fmt.Fprintf(w, "memory used:   %.1f MiB\n", float64(mem.Sys)/(1<<20))
 }
 
 // Len returns the number of lines.
 func (s byKey) Len() int { return len(s.lines) }
 
 // Swap swaps two lines.
-func (s byKey) Swap(i, j int) { s.lines[i], s.lines[j] = s.lines[j], s.lines[i] }
+func (s byKey) Swap(i, j int) {
+	s.lines[i], s.lines[j] = s.lines[j], s.lines[i]
+	if s.keys != nil {
+		s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+		s.order[i], s.order[j] = s.order[j], s.order[i]
+	}
+}
 
 // Less compares two lines based on the sort criteria.
 func (s byKey) Less(i, j int) bool {
-	ki := s.getKey(s.lines[i])
-	kj := s.getKey(s.lines[j])
+	if s.keys != nil {
+		return s.lessKeyed(s.lines[i], s.keys[i], s.lines[j], s.keys[j])
+	}
+	return s.less(s.lines[i], s.lines[j])
+}
+
+// less reports whether line a sorts before line b.
+func (s byKey) less(a, b string) bool {
+	return s.lessKeyed(a, s.getKey(a), b, s.getKey(b))
+}
+
+// lessKeyed is less for lines whose keys ki and kj are already extracted.
+func (s byKey) lessKeyed(a, ki, b, kj string) bool {
+	if s.stats != nil {
+		s.stats.comparisons++
+	}
 	compare := s.compareKeys(ki, kj)
-	less := compare < 0
+	if compare == 0 && s.stableOutput {
+		compare = strings.Compare(a, b)
+	}
+	// -r swaps the order of unequal keys only; equal ones stay unordered
+	// so that sort.Stable and the -c check see them as ties.
 	if s.reverse {
-		less = !less
+		return compare > 0
 	}
-	return less
+	return compare < 0
 }
 
-// getKey extracts the sort key from a line.
+// getKey extracts the sort key from a line and applies the replacements.
 func (s byKey) getKey(line string) string {
-	if s.column <= 0 {
-		return line
+	key := s.extractKey(line)
+	for _, r := range s.replacements {
+		if !r.once {
+			key = r.re.ReplaceAllString(key, r.repl)
+		} else if loc := r.re.FindStringSubmatchIndex(key); loc != nil {
+			key = key[:loc[0]] + string(r.re.ExpandString(nil, r.repl, key, loc)) + key[loc[1]:]
+		}
+	}
+	if s.squeezeBlanks {
+		key = squeezeBlanks(key)
 	}
-	fields := strings.Split(line, "\t")
-	if s.column-1 >= len(fields) {
-		return ""
+	for _, step := range s.keyMap {
+		key = step(key)
+	}
+	if s.keyLimit > 0 {
+		key = truncateRunes(key, s.keyLimit)
+	}
+	return key
+}
+
+// truncateRunes returns the first n runes of s.
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// squeezeBlanks collapses runs of blanks to one space and trims both ends.
+func squeezeBlanks(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// comparedKey returns the key of a line as the comparison sees it, i.e.
+// after replacements and -b trimming.
+func (s byKey) comparedKey(line string) string {
+	key := s.getKey(line)
+	if s.blanks {
+		key = strings.TrimRight(key, " \t")
 	}
-	return fields[s.column-1]
+	return key
+}
+
+// shownKey is the key --show-keys prints: comparedKey, upper-cased under
+// -f as the comparison sees it.
+func (s byKey) shownKey(line string) string {
+	key := s.comparedKey(line)
+	if s.fold {
+		key = strings.ToUpper(key)
+	}
+	return key
+}
+
+// dedupKey is comparedKey upper-cased under -f, or its valueKey under -n,
+// -h and -M, so that checks comparing keys with == find the same
+// duplicates as -u.
+func (s byKey) dedupKey(line string) string {
+	key := s.comparedKey(line)
+	if s.numeric || s.human || s.month {
+		return s.valueKey(key)
+	}
+	if s.fold && !s.foldExact {
+		key = strings.ToUpper(key)
+	}
+	return key
+}
+
+// extractKey returns the raw key of a line before any replacements.
+func (s byKey) extractKey(line string) string {
+	if s.extractor == nil {
+		return line
+	}
+	return s.extractor.key(line)
 }
 
 // compareKeys compares two keys based on the flags.
 func (s byKey) compareKeys(a, b string) int {
+	if s.rank != nil {
+		ra, okA := s.rank[strings.TrimRight(a, " \t")]
+		rb, okB := s.rank[strings.TrimRight(b, " \t")]
+		switch {
+		case okA && !okB:
+			return -1
+		case !okA && okB:
+			return 1
+		case ra != rb:
+			if ra < rb {
+				return -1
+			}
+			return 1
+		}
+	}
+	if s.bytewise {
+		return strings.Compare(a, b)
+	}
 	keyA := a
 	keyB := b
 	if s.blanks {
@@ -103,13 +283,99 @@ func (s byKey) compareKeys(a, b string) int {
 	} else if s.month {
 		ma := parseMonth(trimmedA, keyA)
 		mb := parseMonth(trimmedB, keyB)
-		cmp = monthCmp(ma, mb)
+		if s.monthYear {
+			cmp = cmpInt(parseYear(trimmedA), parseYear(trimmedB))
+		}
+		if cmp == 0 {
+			cmp = monthCmp(ma, mb)
+		}
+	} else if s.paths {
+		cmp = comparePaths(keyA, keyB)
+	} else if s.alphabet != nil {
+		cmp = compareAlphabet(keyA, keyB, s.alphabet)
+	} else if s.domains {
+		cmp = compareDomains(trimmedA, trimmedB)
+	} else if s.emails {
+		cmp = compareEmails(trimmedA, trimmedB)
+	} else if s.uuids != "" {
+		cmp = compareUUIDs(trimmedA, trimmedB, s.uuids == "time")
+	} else if s.entropy {
+		cmp = compareEntropy(keyA, keyB)
+	} else if s.distanceRef != "" {
+		cmp = compareDistance(keyA, keyB, s.distanceRef)
+	} else if s.numericPrefix {
+		cmp = compareNumericPrefix(trimmedA, trimmedB)
+	} else if s.similarRef != "" {
+		cmp = compareJaroWinkler(keyA, keyB, s.similarRef)
+	} else if s.urls != "" {
+		cmp = compareURLs(trimmedA, trimmedB, s.urls == "normalize")
+	} else if s.fold {
+		cmp = compareFold(keyA, keyB)
+		if cmp == 0 && s.foldExact {
+			cmp = strings.Compare(keyA, keyB)
+		}
 	} else {
 		cmp = strings.Compare(keyA, keyB)
 	}
 	return cmp
 }
 
+// sameValue reports whether two keys hold the same -n, -h or -M value.
+// Unlike compareKeys it ignores the raw-string tie-break, so "1", "+1",
+// "1.0" and "1.00" are the same number, and so are "0" and "-0".
+func (s byKey) sameValue(a, b string) bool {
+	if s.blanks {
+		a = strings.TrimRight(a, " \t")
+		b = strings.TrimRight(b, " \t")
+	}
+	a = strings.TrimLeft(a, " \t")
+	b = strings.TrimLeft(b, " \t")
+	switch {
+	case s.human:
+		ha, hb := parseHuman(a, a), parseHuman(b, b)
+		return ha.mantissa == hb.mantissa && (ha.mantissa == 0 || ha.sign == hb.sign && ha.suffixOrder == hb.suffixOrder)
+	case s.numeric:
+		na, nb := parseNumeric(a, a), parseNumeric(b, b)
+		return na.mantissa == nb.mantissa && (na.mantissa == 0 || na.sign == nb.sign)
+	case s.month:
+		if s.monthYear && parseYear(a) != parseYear(b) {
+			return false
+		}
+		return parseMonth(a, a).value == parseMonth(b, b).value
+	}
+	return a == b
+}
+
+// valueKey returns a canonical form of a key's -n, -h or -M value, so that
+// valueKey(a) == valueKey(b) exactly when sameValue(a, b).
+func (s byKey) valueKey(key string) string {
+	if s.blanks {
+		key = strings.TrimRight(key, " \t")
+	}
+	key = strings.TrimLeft(key, " \t")
+	switch {
+	case s.human:
+		h := parseHuman(key, key)
+		if h.mantissa == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%d %d %v", h.sign, h.suffixOrder, h.mantissa)
+	case s.numeric:
+		n := parseNumeric(key, key)
+		if n.mantissa == 0 {
+			return "0"
+		}
+		return fmt.Sprintf("%d %v", n.sign, n.mantissa)
+	case s.month:
+		m := strconv.Itoa(parseMonth(key, key).value)
+		if s.monthYear {
+			m += " " + strconv.Itoa(parseYear(key))
+		}
+		return m
+	}
+	return key
+}
+
 // parseNumeric parses a string for numeric sort.
 func parseNumeric(trimmed, raw string) numVal {
 	var hasDigit bool
@@ -209,7 +475,10 @@ func parseHuman(trimmed, raw string) humanVal {
 			hasDigit = true
 		} else if c == '.' && !hasDot && !hasE {
 			hasDot = true
-		} else if (c == 'e' || c == 'E') && hasDigit && !hasE {
+		} else if (c == 'e' || c == 'E') && hasDigit && !hasE && i+1 < len(trimmed) &&
+			(trimmed[i+1] >= '0' && trimmed[i+1] <= '9' || trimmed[i+1] == '+' || trimmed[i+1] == '-') {
+			// An exponent only when something follows; a bare "1e" is
+			// one exabyte.
 			hasE = true
 			hasDot = false
 		} else if (c == '+' || c == '-') && hasE && (trimmed[i-1] == 'e' || trimmed[i-1] == 'E') {
@@ -220,6 +489,10 @@ func parseHuman(trimmed, raw string) humanVal {
 	}
 	numStr := trimmed[start:i]
 	suffixStr := trimmed[i:]
+	if unit := strings.TrimLeft(suffixStr, " \t"); unit != suffixStr && isUnitToken(unit) {
+		// "1.5 G", as df -h and people write it.
+		suffixStr = unit
+	}
 	if !hasDigit {
 		numStr = "0"
 	}
@@ -248,9 +521,13 @@ func parseHuman(trimmed, raw string) humanVal {
 	}
 	suffixOrder := 0
 	if len(suffixStr) > 0 {
+		// Suffixes are case-insensitive: "1m" is the same as "1M".
 		c := suffixStr[0]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
 		switch c {
-		case 'k', 'K':
+		case 'K':
 			suffixOrder = 1
 		case 'M':
 			suffixOrder = 2
@@ -274,22 +551,40 @@ func parseHuman(trimmed, raw string) humanVal {
 	return humanVal{sig, suffixOrder, mant, raw}
 }
 
+// isUnitToken reports whether s starts with a size unit standing on its
+// own: one suffix letter, optionally followed by "B" or "iB", and then
+// the end or a blank. "G", "GB" and "GiB" qualify; "Gates" does not.
+func isUnitToken(s string) bool {
+	if s == "" || !strings.ContainsRune("KMGTPEZYkmgtpezy", rune(s[0])) {
+		return false
+	}
+	rest := s[1:]
+	for _, unit := range []string{"iB", "ib", "B", "b"} {
+		if strings.HasPrefix(rest, unit) {
+			rest = rest[len(unit):]
+			break
+		}
+	}
+	return rest == "" || rest[0] == ' ' || rest[0] == '\t'
+}
+
 // humanCmp compares two humanVal.
 func humanCmp(ha, hb humanVal) int {
 	cmpSign := cmpInt(ha.sign, hb.sign)
 	if cmpSign != 0 {
 		return cmpSign
 	}
-	cmpSuffix := cmpInt(ha.suffixOrder, hb.suffixOrder)
-	if cmpSuffix != 0 {
-		return cmpSuffix
+	// Suffix, then mantissa, orders magnitudes; for negative values the
+	// larger magnitude is the smaller value, so both are inverted.
+	cmpMag := cmpInt(ha.suffixOrder, hb.suffixOrder)
+	if cmpMag == 0 {
+		cmpMag = cmpFloat(ha.mantissa, hb.mantissa)
 	}
-	cmpMant := cmpFloat(ha.mantissa, hb.mantissa)
 	if ha.sign == -1 {
-		cmpMant = -cmpMant
+		cmpMag = -cmpMag
 	}
-	if cmpMant != 0 {
-		return cmpMant
+	if cmpMag != 0 {
+		return cmpMag
 	}
 	return strings.Compare(ha.raw, hb.raw)
 }
@@ -307,6 +602,28 @@ func parseMonth(trimmed, raw string) monthVal {
 	return monthVal{v, raw}
 }
 
+// noYear is what parseYear returns for a key without a year: later than
+// any four-digit year, so yearless keys follow the dated ones and sort by
+// month among themselves.
+const noYear = 10000
+
+// parseYear returns the first four-digit number following the month name
+// of a --month-year key, as in "Mar 2023" or "Mar-2023", or noYear if
+// there is none.
+func parseYear(trimmed string) int {
+	words := strings.FieldsFunc(trimmed, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for i := 1; i < len(words); i++ {
+		if w := words[i]; len(w) == 4 {
+			if y, err := strconv.Atoi(w); err == nil {
+				return y
+			}
+		}
+	}
+	return noYear
+}
+
 // monthCmp compares two monthVal.
 func monthCmp(ma, mb monthVal) int {
 	cmpV := cmpInt(ma.value, mb.value)
@@ -340,76 +657,1406 @@ func cmpFloat(x, y float64) int {
 	return 0
 }
 
-func main() {
-	column := flag.Int("k", 0, "sort by column N (1-based, default whole line)")
-	numeric := flag.Bool("n", false, "sort by numerical value")
-	reverse := flag.Bool("r", false, "sort in reverse order")
-	unique := flag.Bool("u", false, "output unique lines only")
-	month := flag.Bool("M", false, "sort by month name")
-	blanks := flag.Bool("b", false, "ignore trailing blanks")
-	check := flag.Bool("c", false, "check if data is sorted")
-	human := flag.Bool("h", false, "sort by human-readable numeric value")
-	flag.Parse()
-
-	if *month && (*numeric || *human) {
-		log.Fatal("Cannot combine month and numeric/human sort")
-	}
-	if *numeric && *human {
-		log.Fatal("Cannot combine numeric and human-numeric sort")
-	}
-
-	var reader io.Reader
-	args := flag.Args()
-	if len(args) > 1 {
-		log.Fatal("Too many input files; only one file or STDIN supported")
-	} else if len(args) == 1 {
-		f, err := os.Open(args[0])
-		if err != nil {
-			log.Fatal(err)
+// presorted reports whether the lines are already in order (1), in
+// strictly reverse order (-1), or neither (0). It stops at the first pair
+// that rules out both, so unsorted input costs only a few comparisons.
+func (s byKey) presorted() int {
+	asc, desc := true, true
+	for i := 1; i < len(s.lines) && (asc || desc); i++ {
+		if s.Less(i, i-1) {
+			asc = false
+		} else {
+			desc = false
 		}
-		defer f.Close()
-		reader = f
-	} else {
-		reader = os.Stdin
 	}
+	if asc {
+		return 1
+	}
+	if desc {
+		return -1
+	}
+	return 0
+}
+
+// inputFilter drops lines while the input is read.
+type inputFilter struct {
+	removeBlank    bool
+	commentPrefix  string
+	trimLeft       bool // --trim-output-left
+	trimRight      bool // --trim-output-right
+	blankRemoved   int
+	commentRemoved int
+}
+
+// trim applies --trim-output, --trim-output-left and --trim-output-right
+// to a line as it is read, before keep sees it.
+func (f *inputFilter) trim(line string) string {
+	switch {
+	case f.trimLeft && f.trimRight:
+		return strings.TrimSpace(line)
+	case f.trimLeft:
+		return strings.TrimLeftFunc(line, unicode.IsSpace)
+	case f.trimRight:
+		return strings.TrimRightFunc(line, unicode.IsSpace)
+	}
+	return line
+}
+
+// keep reports whether line should be sorted and counts the lines it drops.
+func (f *inputFilter) keep(line string) bool {
+	if f.removeBlank && line == "" {
+		f.blankRemoved++
+		return false
+	}
+	if f.commentPrefix != "" && strings.HasPrefix(line, f.commentPrefix) {
+		f.commentRemoved++
+		return false
+	}
+	return true
+}
+
+// report prints the number of removed lines.
+func (f *inputFilter) report(w io.Writer) {
+	if f.removeBlank {
+		fmt.Fprintf(w, "removed %d blank lines\n", f.blankRemoved)
+	}
+	if f.commentPrefix != "" {
+		fmt.Fprintf(w, "removed %d comment lines\n", f.commentRemoved)
+	}
+}
+
+// checkResult describes the outcome of checkSorted.
+type checkResult struct {
+	sorted    bool
+	line      int    // 1-based number of the first offending line
+	text      string // content of the first offending line
+	duplicate bool   // the offending line repeats its predecessor
+}
+
+// checkSorted reads r and reports whether its lines are in order under
+// the sorter's settings. With dedup.unique set, a line that duplicates its
+// predecessor under dedup also counts as a violation.
+func checkSorted(r io.Reader, sorter byKey, dedup dedupConfig, filter *inputFilter, delim byte) (checkResult, error) {
+	scanner := newLineScanner(r, delim)
+	prev := ""
+	n := 0
+	first := true
+	for scanner.Scan() {
+		line := scanner.Text()
+		n++
+		if !filter.keep(line) {
+			continue
+		}
+		if !first {
+			if sorter.less(line, prev) {
+				return checkResult{line: n, text: line}, nil
+			}
+			if dedup.unique && sorter.duplicates(dedup, line, prev) {
+				return checkResult{line: n, text: line, duplicate: true}, nil
+			}
+		}
+		prev = line
+		first = false
+	}
+	if err := scanner.Err(); err != nil {
+		return checkResult{}, err
+	}
+	return checkResult{sorted: true}, nil
+}
 
-	lines := []string{}
-	scanner := bufio.NewScanner(reader)
+// findDuplicateKey streams r and reports the first line whose compared key
+// was already seen, without sorting. Keys are kept in a set indexed by
+// hash, with the keys themselves stored to confirm a match, so memory is
+// proportional to the number of distinct keys.
+func findDuplicateKey(r io.Reader, sorter byKey, filter *inputFilter, delim byte) (checkResult, error) {
+	seed := maphash.MakeSeed()
+	seen := map[uint64][]string{}
+	scanner := newLineScanner(r, delim)
+	n := 0
 	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
+		line := scanner.Text()
+		n++
+		if !filter.keep(line) {
+			continue
+		}
+		key := sorter.dedupKey(line)
+		h := maphash.String(seed, key)
+		for _, k := range seen[h] {
+			if k == key {
+				return checkResult{line: n, text: sorter.comparedKey(line), duplicate: true}, nil
+			}
+		}
+		seen[h] = append(seen[h], key)
 	}
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return checkResult{}, err
+	}
+	return checkResult{sorted: true}, nil
+}
+
+// dedupAdjacent copies lines from scanner to w in input order, dropping
+// every line whose compared key equals that of the line before it, like
+// uniq. Only the previous key is kept in memory.
+func dedupAdjacent(scanner *bufio.Scanner, w *lineWriter, sorter byKey, filter *inputFilter) error {
+	prev, started := "", false
+	for scanner.Scan() {
+		line := filter.trim(scanner.Text())
+		if !filter.keep(line) {
+			continue
+		}
+		key := sorter.comparedKey(line)
+		if started && key == prev {
+			continue
+		}
+		prev, started = key, true
+		if err := w.writeLine(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// approxUnique copies lines from scanner to w in input order, dropping
+// every line whose compared key the Bloom filter has seen before. Unlike
+// -u it needs memory only for the filter, but a false positive drops a
+// line that was not a duplicate.
+func approxUnique(scanner *bufio.Scanner, w *lineWriter, sorter byKey, filter *inputFilter, seen *scalableBloom) error {
+	for scanner.Scan() {
+		line := filter.trim(scanner.Text())
+		if !filter.keep(line) || seen.seen(sorter.dedupKey(line)) {
+			continue
+		}
+		if err := w.writeLine(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// dedupConfig controls the -u pass over sorted lines.
+type dedupConfig struct {
+	unique   bool
+	minCount int  // drop groups seen fewer times than this (0 = no limit)
+	maxCount int  // drop groups seen more times than this (0 = no limit)
+	onKeys   bool // lines are duplicates when their compared keys match
+	squeeze  bool // lines are duplicates when equal after squeezeBlanks
+	compared bool // lines are duplicates when their keys compare equal
+	byValue  bool // lines are duplicates when their -n/-h/-M values are equal
+}
+
+// newDedupConfig returns the -u settings selected by o.
+func newDedupConfig(o *options) dedupConfig {
+	return dedupConfig{
+		unique:   o.unique,
+		minCount: o.minCount,
+		maxCount: o.maxCount,
+		onKeys:   o.keysOnly,
+		squeeze:  o.uniqueNormalized,
+		compared: o.email || o.url == "normalize" || o.uuid != "" || o.foldCase || o.keyLengthLimit > 0 || o.keyMapSteps != nil,
+		byValue:  o.numeric || o.human || o.month,
+	}
+}
+
+// duplicates reports whether lines a and b are duplicates under d, for
+// passes that see one pair of lines at a time rather than sortIndexed's
+// decorated keys.
+func (s byKey) duplicates(d dedupConfig, a, b string) bool {
+	switch {
+	case d.byValue:
+		return s.sameValue(s.getKey(a), s.getKey(b))
+	case d.compared:
+		return s.compareKeys(s.getKey(a), s.getKey(b)) == 0
+	case d.onKeys:
+		return s.comparedKey(a) == s.comparedKey(b)
+	case d.squeeze:
+		return squeezeBlanks(a) == squeezeBlanks(b)
+	}
+	return a == b
+}
+
+// longLine is the length from which the -u pass compares line hashes
+// before comparing bytes.
+const longLine = 1024
+
+// lineHashSeeds seed the two halves of a 128-bit line hash.
+var lineHashSeeds = [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()}
+
+// lineHash is a 128-bit hash of a line's content.
+type lineHash [2]uint64
+
+func hashLine(line string) lineHash {
+	return lineHash{maphash.String(lineHashSeeds[0], line), maphash.String(lineHashSeeds[1], line)}
+}
+
+// equalLines returns an index-based equality test for lines. Long lines
+// are hashed once up front, so near-identical neighbours are told apart
+// by their hashes instead of a full byte comparison; bytes are only
+// compared when the hashes agree.
+func equalLines(lines []string) func(i, j int) bool {
+	hashes := make([]lineHash, len(lines))
+	for i, line := range lines {
+		if len(line) >= longLine {
+			hashes[i] = hashLine(line)
+		}
+	}
+	return func(i, j int) bool {
+		a, b := lines[i], lines[j]
+		if len(a) != len(b) {
+			return false
+		}
+		if len(a) >= longLine && hashes[i] != hashes[j] {
+			return false
+		}
+		return a == b
+	}
+}
+
+// sortLines sorts lines in place using the sorter's settings and, when
+// dedup.unique is set, drops adjacent duplicates from the result.
+func (s byKey) sortLines(lines []string, dedup dedupConfig) []string {
+	sorted, _ := s.sortIndexed(lines, dedup)
+	return sorted
+}
+
+// sortIndexed is sortLines that also returns, for every output line, its
+// 0-based position in the input.
+func (s byKey) sortIndexed(lines []string, dedup dedupConfig) ([]string, []int) {
+	s.lines = lines
+	start := time.Now()
+	// Decorate: extract every key once instead of on each comparison.
+	s.keys = make([]string, len(lines))
+	s.order = make([]int, len(lines))
+	for i, line := range lines {
+		s.keys[i] = s.getKey(line)
+		s.order[i] = i
+	}
+	switch s.presorted() {
+	case 1: // already in order
+	case -1:
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			s.Swap(i, j)
+		}
+	default:
+		if s.preserveOrder {
+			sort.Stable(s)
+		} else {
+			sort.Sort(s)
+		}
+	}
+	if s.stats != nil {
+		s.stats.sortTime += time.Since(start)
+	}
+	if !dedup.unique {
+		return lines, s.order
+	}
+	// The whole-line test is the fallback; its hashes are only built
+	// when no other test replaces it.
+	var same func(i, j int) bool
+	switch {
+	case dedup.byValue:
+		same = func(i, j int) bool { return s.sameValue(s.keys[i], s.keys[j]) }
+	case dedup.compared:
+		same = func(i, j int) bool { return s.compareKeys(s.keys[i], s.keys[j]) == 0 }
+	case dedup.onKeys:
+		same = func(i, j int) bool {
+			if s.blanks {
+				return strings.TrimRight(s.keys[i], " \t") == strings.TrimRight(s.keys[j], " \t")
+			}
+			return s.keys[i] == s.keys[j]
+		}
+	case dedup.squeeze:
+		// Lines that are equal once squeezed can have keys that sort
+		// apart, so they are matched through a set rather than as
+		// neighbours.
+		uniqLines, uniqOrder := uniqueSqueezed(lines, s.order, dedup)
+		if s.stats != nil {
+			s.stats.linesKept += len(uniqLines)
+			s.stats.linesRemoved += len(lines) - len(uniqLines)
+		}
+		return uniqLines, uniqOrder
+	default:
+		same = equalLines(lines)
+	}
+	uniqLines := []string{}
+	uniqOrder := []int{}
+	for i := 0; i < len(lines); {
+		j := i + 1
+		for j < len(lines) && same(i, j) {
+			j++
+		}
+		count := j - i
+		if (dedup.minCount <= 0 || count >= dedup.minCount) &&
+			(dedup.maxCount <= 0 || count <= dedup.maxCount) {
+			// Keep the group's earliest input line; sort.Sort is not stable.
+			// Spellings of one number keep the first in sorted order, and
+			// the earliest of its copies.
+			first := i
+			for k := i + 1; k < j; k++ {
+				if dedup.byValue && lines[k] != lines[i] {
+					continue
+				}
+				if s.order[k] < s.order[first] {
+					first = k
+				}
+			}
+			uniqLines = append(uniqLines, lines[first])
+			uniqOrder = append(uniqOrder, s.order[first])
+		}
+		i = j
+	}
+	if s.stats != nil {
+		s.stats.linesKept += len(uniqLines)
+		s.stats.linesRemoved += len(lines) - len(uniqLines)
+	}
+	return uniqLines, uniqOrder
+}
+
+// uniqueSqueezed is the --unique-normalized pass of sortIndexed: of the
+// sorted lines that are equal after squeezeBlanks, it keeps the earliest
+// input line, at its own sorted position, when the number of copies is
+// within dedup's counts.
+func uniqueSqueezed(lines []string, order []int, dedup dedupConfig) ([]string, []int) {
+	squeezed := make([]string, len(lines))
+	count := map[string]int{}
+	first := map[string]int{}
+	for i, line := range lines {
+		key := squeezeBlanks(line)
+		squeezed[i] = key
+		count[key]++
+		if f, ok := first[key]; !ok || order[i] < order[f] {
+			first[key] = i
+		}
+	}
+	uniqLines := []string{}
+	uniqOrder := []int{}
+	for i, key := range squeezed {
+		n := count[key]
+		if first[key] == i && (dedup.minCount <= 0 || n >= dedup.minCount) &&
+			(dedup.maxCount <= 0 || n <= dedup.maxCount) {
+			uniqLines = append(uniqLines, lines[i])
+			uniqOrder = append(uniqOrder, order[i])
+		}
+	}
+	return uniqLines, uniqOrder
+}
+
+// followInput keeps reading the input and prints it in sorted batches. A
+// batch is flushed every interval (if positive), whenever a line equal to
+// marker arrives (if non-empty), and at EOF. Each batch is sorted on its
+// own; lines are never reordered across batches.
+func followInput(scanner *bufio.Scanner, w *lineWriter, sorter byKey, dedup dedupConfig, filter *inputFilter, interval time.Duration, marker string) error {
+	lineCh := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		for scanner.Scan() {
+			if sorter.stats != nil {
+				sorter.stats.linesRead++
+			}
+			if line := filter.trim(scanner.Text()); filter.keep(line) {
+				lineCh <- line
+			}
+		}
+		errCh <- scanner.Err()
+		close(lineCh)
+	}()
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	batch := []string{}
+	flush := func() error {
+		for _, line := range sorter.sortLines(batch, dedup) {
+			if err := w.writeLine(line); err != nil {
+				return err
+			}
+		}
+		batch = []string{}
+		return w.flush()
+	}
+	for {
+		select {
+		case line, ok := <-lineCh:
+			if !ok {
+				if err := flush(); err != nil {
+					return err
+				}
+				return <-errCh
+			}
+			if marker != "" && line == marker {
+				if err := flush(); err != nil {
+					return err
+				}
+				continue
+			}
+			batch = append(batch, line)
+		case <-tick:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// lineSampleSize is how much of a regular file estimateLines inspects.
+const lineSampleSize = 64 << 10
+
+// estimateLines guesses the number of lines in r so the lines slice can be
+// preallocated. It only knows how for regular files; for pipes and other
+// readers it returns 0.
+func estimateLines(r io.Reader) int {
+	f, ok := r.(*os.File)
+	if !ok {
+		return 0
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+		return 0
+	}
+	buf := make([]byte, lineSampleSize)
+	n, err := f.ReadAt(buf, 0)
+	if n == 0 || (err != nil && err != io.EOF) {
+		return 0
+	}
+	newlines := strings.Count(string(buf[:n]), "\n")
+	if newlines == 0 {
+		return 1
+	}
+	return int(info.Size() * int64(newlines) / int64(n))
+}
+
+// startPreSort runs command through the shell with r as its stdin and
+// returns a reader for its stdout together with a function that waits for
+// the command to exit and reports its failure.
+func startPreSort(r io.Reader, command string, stderr io.Writer) (io.Reader, func() error, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = r
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("pre-sort command %q: %v", command, err)
+	}
+	wait := func() error {
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("pre-sort command %q: %v", command, err)
+		}
+		return nil
+	}
+	return out, wait, nil
+}
+
+// startPostSort runs command through the shell with its stdout connected
+// to w and returns the command's stdin together with a function that
+// closes it and waits for the command to exit. Calling the function again
+// returns the first result.
+func startPostSort(w io.Writer, command string, stderr io.Writer) (io.Writer, func() error, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("post-sort command %q: %v", command, err)
+	}
+	var once sync.Once
+	var waitErr error
+	wait := func() error {
+		once.Do(func() {
+			in.Close()
+			waitErr = cmd.Wait()
+		})
+		return waitErr
+	}
+	return in, wait, nil
+}
+
+// postSortResult turns the outcome of the --post-sort-command into the
+// error run returns, keeping the command's exit code.
+func postSortResult(err error, command string) error {
+	if err == nil {
+		return nil
+	}
+	code := 1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		code = exitErr.ExitCode()
+	}
+	return &exitError{code, fmt.Errorf("post-sort command %q: %v", command, err)}
+}
+
+// keyWarningSample is the number of leading lines inspected by
+// warnEmptyKeys.
+const keyWarningSample = 1000
+
+// warnEmptyKeys prints a warning to stderr when the -k field is empty or
+// blank for more than 90% of the sampled lines, which usually means the
+// input has fewer fields than expected.
+func warnEmptyKeys(lines []string, sorter byKey, w io.Writer) {
+	field, ok := sorter.extractor.(fieldKey)
+	if !ok {
+		return
+	}
+	sample := lines
+	if len(sample) > keyWarningSample {
+		sample = sample[:keyWarningSample]
+	}
+	empty := 0
+	nonEmptyLine := false
+	for _, line := range sample {
+		if strings.TrimSpace(sorter.extractKey(line)) == "" {
+			empty++
+		}
+		if line != "" {
+			nonEmptyLine = true
+		}
+	}
+	if nonEmptyLine && empty*10 > len(sample)*9 {
+		fmt.Fprintf(w, "Warning: field %d is empty for most lines; check your -t delimiter\n", field.column)
+	}
+}
+
+// unsafeFileChars matches characters not allowed in --split-by-key names.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// inversePermutation implements --inverse-sort. sorted[j] is input line
+// order[j]; the result places input line i at position order[i], so
+// picking its lines in the order of the sort permutation gives back the
+// input. The returned positions say where each output line came from, as
+// sortIndexed's do.
+func inversePermutation(sorted []string, order []int) ([]string, []int) {
+	input := make([]string, len(order))
+	for j, i := range order {
+		input[i] = sorted[j]
+	}
+	out := make([]string, len(order))
+	from := make([]int, len(order))
+	for i, line := range input {
+		out[order[i]] = line
+		from[order[i]] = i
+	}
+	return out, from
+}
+
+// uniqueByKey implements --unique-key: of the sorted lines sharing a key
+// from extractor, only the first is kept, with its position. The key is
+// normalized like the comparison's: blanks trims trailing blanks and fold
+// ignores case.
+func uniqueByKey(sorted []string, order []int, extractor keyExtractor, blanks, fold bool) ([]string, []int) {
+	seen := map[string]bool{}
+	uniqLines := []string{}
+	uniqOrder := []int{}
+	for i, line := range sorted {
+		key := extractor.key(line)
+		if blanks {
+			key = strings.TrimRight(key, " \t")
+		}
+		if fold {
+			key = strings.ToUpper(key)
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		uniqLines = append(uniqLines, line)
+		uniqOrder = append(uniqOrder, order[i])
 	}
+	return uniqLines, uniqOrder
+}
+
+// pageLines keeps the limit lines after the first offset of the sorted
+// lines and their positions, or all lines after offset when limit is -1.
+func pageLines(sorted []string, order []int, offset, limit int) ([]string, []int) {
+	start := min(offset, len(sorted))
+	end := len(sorted)
+	if limit >= 0 {
+		end = min(start+limit, end)
+	}
+	return sorted[start:end], order[start:end]
+}
 
-	sorter := byKey{
-		lines:   lines,
-		column:  *column,
-		numeric: *numeric,
-		human:   *human,
-		month:   *month,
-		blanks:  *blanks,
-		reverse: *reverse,
+// logKeyCollisions writes each adjacent pair of sorted lines whose keys
+// compare equal to the file name, the two lines followed by a blank line.
+// A group of n lines with one key gives n-1 pairs. With skipEmpty the file
+// is not created when there is nothing to log.
+func logKeyCollisions(name string, lines []string, sorter byKey, skipEmpty bool) error {
+	var b strings.Builder
+	for i := 1; i < len(lines); i++ {
+		if sorter.compareKeys(sorter.comparedKey(lines[i-1]), sorter.comparedKey(lines[i])) == 0 {
+			fmt.Fprintf(&b, "%s\n%s\n\n", lines[i-1], lines[i])
+		}
+	}
+	if b.Len() == 0 && skipEmpty {
+		return nil
 	}
+	return os.WriteFile(name, []byte(b.String()), 0o644)
+}
 
-	if *check {
-		if !sort.IsSorted(sorter) {
-			fmt.Println("Data is not sorted")
-			os.Exit(1)
+// writeKeyPositions writes the --key-position-map file: a JSON object
+// mapping each compared key of the sorted lines to the 1-based position
+// of its first line. With -n a key is written as its numeric value, so
+// "1.0" and "01" share the entry "1".
+func writeKeyPositions(name string, lines []string, sorter byKey) error {
+	positions := map[string]int{}
+	for i, line := range lines {
+		key := sorter.comparedKey(line)
+		if sorter.numeric {
+			trimmed := strings.TrimLeft(key, " \t")
+			n := parseNumeric(trimmed, trimmed)
+			key = strconv.FormatFloat(float64(n.sign)*n.mantissa, 'g', -1, 64)
+		}
+		if _, ok := positions[key]; !ok {
+			positions[key] = i + 1
 		}
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(positions); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// numberEnd returns the length of the number at the start of s, in the
+// syntax parseNumeric reads, or -1 when s does not start with one.
+func numberEnd(s string) int {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	hasDigit, hasDot, hasE := false, false, false
+	for ; i < len(s); i++ {
+		c := s[i]
+		if c >= '0' && c <= '9' {
+			hasDigit = true
+		} else if c == '.' && !hasDot && !hasE {
+			hasDot = true
+		} else if (c == 'e' || c == 'E') && hasDigit && !hasE && i+1 < len(s) && (s[i+1] >= '0' && s[i+1] <= '9' || s[i+1] == '+' || s[i+1] == '-') {
+			hasE = true
+		} else if (c == '+' || c == '-') && hasE && (s[i-1] == 'e' || s[i-1] == 'E') {
+			// exponent sign
+		} else {
+			break
+		}
+	}
+	if !hasDigit {
+		return -1
+	}
+	return i
+}
+
+// checkNumericKeys implements --strict-numeric for -n and -h: every key
+// must start with a number, and with level "trailing" hold nothing after
+// it but blanks or, for -h, one size unit. The first bad key exits with
+// status 2. lineNos holds the input line number of each line.
+func checkNumericKeys(lines []string, lineNos []int, sorter byKey, level string) error {
+	for i, line := range lines {
+		key := strings.Trim(sorter.comparedKey(line), " \t")
+		end := numberEnd(key)
+		if end < 0 {
+			return &exitError{code: 2, err: fmt.Errorf("line %d: not a number: %q", lineNos[i], key)}
+		}
+		if level != "trailing" {
+			continue
+		}
+		rest := strings.TrimLeft(key[end:], " \t")
+		if rest == "" || sorter.human && isUnitToken(rest) && !strings.ContainsAny(rest, " \t") {
+			continue
+		}
+		return &exitError{code: 2, err: fmt.Errorf("line %d: trailing characters after number: %q", lineNos[i], key)}
+	}
+	return nil
+}
+
+// checkMonthKeys implements --strict-month: the leading word of every
+// key must be a month name or an abbreviation of one with at least three
+// letters, such as "Sep" or "Sept". The first bad key exits with status 2.
+// lineNos holds the input line number of each line.
+func checkMonthKeys(lines []string, lineNos []int, sorter byKey) error {
+	for i, line := range lines {
+		key := strings.TrimLeft(sorter.comparedKey(line), " \t")
+		word := key
+		if end := strings.IndexFunc(key, func(r rune) bool { return !unicode.IsLetter(r) }); end >= 0 {
+			word = key[:end]
+		}
+		if !isMonthName(strings.ToUpper(word)) {
+			return &exitError{code: 2, err: fmt.Errorf("line %d: not a month: %q", lineNos[i], key)}
+		}
+	}
+	return nil
+}
+
+// isMonthName reports whether the upper-case word names a month.
+func isMonthName(word string) bool {
+	if len(word) < 3 {
+		return false
+	}
+	for _, name := range monthNames {
+		if strings.HasPrefix(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrderKeys implements --strict: every key must be listed in the
+// --order-file. lineNos holds the input line number of each line.
+func checkOrderKeys(lines []string, lineNos []int, sorter byKey) error {
+	for i, line := range lines {
+		key := sorter.comparedKey(line)
+		if _, ok := sorter.rank[strings.TrimRight(key, " \t")]; !ok {
+			return fmt.Errorf("line %d: key %q is not listed in the --order-file", lineNos[i], key)
+		}
+	}
+	return nil
+}
+
+// sanitizeFileName turns a key into something usable as a file name.
+func sanitizeFileName(key string) string {
+	name := unsafeFileChars.ReplaceAllString(key, "_")
+	if name == "" || name == "." || name == ".." {
+		name = "_" + name
+	}
+	return name
+}
+
+// splitByKey writes sorted lines into one file per key value and returns
+// the number of files written. target is either a directory, in which
+// case files are named after the key, or a path template containing
+// "{key}". Only one file is open at a time since equal keys are adjacent.
+func splitByKey(lines []string, sorter byKey, target string, eol byte) (int, error) {
+	template := target
+	if !strings.Contains(target, "{key}") {
+		if err := os.MkdirAll(target, 0o755); err != nil {
+			return 0, err
+		}
+		template = filepath.Join(target, "{key}")
+	}
+
+	seen := map[string]string{}
+	var f *os.File
+	var w *bufio.Writer
+	closeCurrent := func() error {
+		if f == nil {
+			return nil
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	prevKey := ""
+	for i, line := range lines {
+		key := sorter.getKey(line)
+		if i == 0 || key != prevKey {
+			if err := closeCurrent(); err != nil {
+				return len(seen), err
+			}
+			name := strings.ReplaceAll(template, "{key}", sanitizeFileName(key))
+			if other, ok := seen[name]; ok {
+				return len(seen), fmt.Errorf("keys %q and %q both map to file %s", other, key, name)
+			}
+			seen[name] = key
+			var err error
+			f, err = os.Create(name)
+			if err != nil {
+				return len(seen), err
+			}
+			w = bufio.NewWriter(f)
+			prevKey = key
+		}
+		w.WriteString(line)
+		if err := w.WriteByte(eol); err != nil {
+			closeCurrent()
+			return len(seen), err
+		}
+	}
+	return len(seen), closeCurrent()
+}
+
+// writeChunks writes lines into sequentially numbered files PREFIX.000,
+// PREFIX.001, ... holding n lines each, the last one possibly short. On
+// error every file created so far is removed.
+func writeChunks(lines []string, n int, prefix string, eol byte) (err error) {
+	created := []string{}
+	defer func() {
+		if err != nil {
+			for _, name := range created {
+				os.Remove(name)
+			}
+		}
+	}()
+	for start := 0; start < len(lines); start += n {
+		end := start + n
+		if end > len(lines) {
+			end = len(lines)
+		}
+		name := fmt.Sprintf("%s.%03d", prefix, len(created))
+		f, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		created = append(created, name)
+		w := bufio.NewWriter(f)
+		for _, line := range lines[start:end] {
+			w.WriteString(line)
+			w.WriteByte(eol)
+		}
+		if err := w.Flush(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exitError makes run exit with a specific status. A nil err means the
+// problem has already been reported.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.err }
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		if exitErr.err != nil {
+			log.Print(exitErr.err)
+		}
+		os.Exit(exitErr.code)
+	}
+	log.Print(err)
+	os.Exit(1)
+}
+
+// newSorter builds the comparison settings selected by o.
+func newSorter(o *options) byKey {
+	return byKey{
+		extractor:     o.extractor,
+		bytewise:      o.byteLength > 0 || o.raw,
+		stableOutput:  o.stableOutput,
+		preserveOrder: o.preserveInputOrder,
+		squeezeBlanks: o.uniqueNormalized,
+		numeric:       o.numeric,
+		human:         o.human,
+		month:         o.month,
+		paths:         o.paths,
+		domains:       o.domain,
+		emails:        o.email,
+		urls:          o.url,
+		entropy:       o.byEntropy,
+		distanceRef:   o.byDistance,
+		similarRef:    o.byJaroWinkler,
+		numericPrefix: o.byNumericPrefix,
+		uuids:         o.uuid,
+		rank:          o.order,
+		alphabet:      o.alphabetRank,
+		fold:          o.foldCase,
+		foldExact:     o.foldThenExact,
+		keyLimit:      o.keyLengthLimit,
+		monthYear:     o.monthYear,
+		keyMap:        o.keyMapSteps,
+		blanks:        o.blanks,
+		reverse:       o.reverse,
+		replacements:  o.replacements,
+	}
+}
+
+// run is the whole program: it parses args, sorts, checks or merges the
+// inputs and writes the result to stdout. Every resource it opens is
+// released through defers before it returns, including on errors.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	o, err := parseOptions(args, stderr)
+	if err != nil {
+		return err
+	}
+	if o.cpuProfile != "" || o.memProfile != "" {
+		stopProfiles, err := startProfiles(o.cpuProfile, o.memProfile)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := stopProfiles(); err != nil {
+				fmt.Fprintf(stderr, "Warning: writing profile: %v\n", err)
+			}
+		}()
+	}
+
+	names, err := expandGlobs(o.files, o.globs, o.globNoMatch == "warn", stderr)
+	if err != nil {
+		return err
+	}
+	if o.lineBuffered && isRegularFile(stdout) {
+		o.lineBuffered = false
+	}
+	if o.merge && len(names) > o.mergeLimit {
+		var removeTemps func()
+		names, removeTemps, err = mergeFiles(names, o.mergeLimit, func(w io.Writer, group []string) error {
+			return mergeGroup(w, o, group, stdin, stderr)
+		})
+		defer removeTemps()
+		if err != nil {
+			return err
+		}
+	}
+	readers, closeInputs, err := openInputs(names, stdin, o.timeout)
+	if err != nil {
+		return err
+	}
+	defer closeInputs()
+	// The input size says nothing about the number of lines sorted when a
+	// --pre-sort-command rewrites the stream or --sort-to-line stops early.
+	sized := o.preSortCommand == "" && o.sortToLine < 0
+	estimate := 0
+	for i, r := range readers {
+		if sized {
+			estimate += estimateLines(r)
+		}
+		if o.detectEncoding {
+			readers[i] = detectEncoding(r)
+		}
+	}
+	reader := concatInputs(readers, o.delims.in)
+	waitPreSort := func() error { return nil }
+	if o.preSortCommand != "" {
+		reader, waitPreSort, err = startPreSort(reader, o.preSortCommand, stderr)
+		if err != nil {
+			return err
+		}
+	}
+
+	sorter := newSorter(o)
+	if o.outputStats || o.reportUnique {
+		sorter.stats = &sortStats{}
+	}
+	if o.outputStats {
+		defer sorter.stats.print(stderr)
+	}
+
+	dedup := newDedupConfig(o)
+
+	dest := stdout
+	waitPostSort := func() error { return nil }
+	if o.postSortCommand != "" {
+		dest, waitPostSort, err = startPostSort(stdout, o.postSortCommand, stderr)
+		if err != nil {
+			return err
+		}
+		// Make sure the command is reaped even when we fail first.
+		defer waitPostSort()
+	}
+	out := bufio.NewWriter(dest)
+	lw := &lineWriter{
+		w:            out,
+		sorter:       sorter,
+		showKeys:     o.showKeys,
+		keysOnly:     o.keysOnly,
+		fieldMap:     o.fieldMap,
+		project:      o.project,
+		sep:          o.separator,
+		quote:        o.quote,
+		eol:          o.delims.out,
+		format:       o.format,
+		stableIndex:  o.stableIndex,
+		wrapWidth:    o.wordWrap,
+		wrapIndent:   o.wrapIndent,
+		sepAtEnd:     o.separatorAtEnd,
+		outSep:       o.outputSeparator,
+		lineBuffered: o.lineBuffered,
+	}
+
+	filter := &inputFilter{removeBlank: o.removeBlank, commentPrefix: o.commentPrefix, trimLeft: o.trimOutputLeft, trimRight: o.trimOutputRight}
+	if o.verbose {
+		defer filter.report(stderr)
+	}
+
+	if o.headerFile != "" {
+		header, err := readHeader(o.headerFile, o.headerCount, o.delims.in)
+		if err != nil {
+			return err
+		}
+		for _, line := range header {
+			out.WriteString(line)
+			out.WriteByte(o.delims.out)
+		}
+	}
+
+	if o.merge {
+		err := mergeReaders(out, sorter, newMergeConfig(o, names, stderr), readers...)
+		if err := mergeError(err, names); err != nil {
+			return err
+		}
+		return finishOutput(nil, waitPostSort, o.postSortCommand)
+	}
+
+	if o.check {
+		res, err := checkSorted(reader, sorter, newDedupConfig(o), filter, o.delims.in)
+		if err != nil {
+			return err
+		}
+		if err := waitPreSort(); err != nil {
+			return err
+		}
+		if !res.sorted {
+			problem := "disorder"
+			if res.duplicate {
+				problem = "duplicate"
+			}
+			fmt.Fprintf(stdout, "Data is not sorted: line %d: %s: %s\n", res.line, problem, res.text)
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+
+	if o.checkDupesOnly {
+		res, err := findDuplicateKey(reader, sorter, filter, o.delims.in)
+		if err != nil {
+			return err
+		}
+		if err := waitPreSort(); err != nil {
+			return err
+		}
+		if !res.sorted {
+			fmt.Fprintf(stdout, "Duplicate key: line %d: %s\n", res.line, res.text)
+			return &exitError{code: 1}
+		}
+		return nil
+	}
+
+	scanner := newLineScanner(reader, o.delims.in)
+	if o.follow {
+		err := followInput(scanner, lw, sorter, dedup, filter, o.flushInterval, o.flushMarker)
+		if err == nil {
+			err = waitPreSort()
+		}
+		if err := finishOutput(err, waitPostSort, o.postSortCommand); err != nil {
+			return err
+		}
+		reportUnique(o, sorter.stats, stderr)
+		return nil
+	}
+
+	if o.uniqueApprox != "" {
+		err := approxUnique(scanner, lw, sorter, filter, newScalableBloom(o.uniqueApproxSize, o.approxRate))
+		if err == nil {
+			err = waitPreSort()
+		}
+		return finishOutput(err, waitPostSort, o.postSortCommand)
+	}
+	if o.dedupAdjacent {
+		err := dedupAdjacent(scanner, lw, sorter, filter)
+		if err == nil {
+			err = waitPreSort()
+		}
+		return finishOutput(err, waitPostSort, o.postSortCommand)
+	}
+
+	var exclude, include *keySet
+	if o.excludeFile != "" {
+		if exclude, err = loadKeySet(o.excludeFile, sorter, o.delims.in); err != nil {
+			return err
+		}
+	}
+	if o.includeFile != "" {
+		if include, err = loadKeySet(o.includeFile, sorter, o.delims.in); err != nil {
+			return err
+		}
+	}
+	// --sort-from-line: the first lines are copied through unsorted.
+	skipped := 0
+	for skipped < o.sortFromLine && scanner.Scan() {
+		if sorter.stats != nil {
+			sorter.stats.linesRead++
+		}
+		if err := lw.writeRaw(filter.trim(scanner.Text())); err != nil {
+			return finishOutput(err, waitPostSort, o.postSortCommand)
+		}
+		skipped++
+	}
+	// --sort-to-line: lines after that one are held back and appended
+	// unsorted.
+	var tail []string
+	var lines []string
+	var sample *reservoir
+	var positions []int     // input position of each line, when not its index
+	var pinned []pinnedLine // --filter: lines that keep their place
+	if o.randomSubset > 0 {
+		seed := o.randomSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		sample = newReservoir(o.randomSubset, seed)
 	} else {
-		sort.Sort(sorter)
-		if *unique {
-			uniqLines := []string{}
-			for i := 0; i < len(lines); i++ {
-				if i == 0 || lines[i] != lines[i-1] {
-					uniqLines = append(uniqLines, lines[i])
+		// The reservoir holds a --random-subset sample itself.
+		lines = make([]string, 0, estimate)
+	}
+	// The key checks report input line numbers, which filtering,
+	// --sort-from-line and --random-subset make differ from line indices.
+	numbered := o.strictNumeric != "" || o.strictMonth || o.strict && o.order != nil
+	var keptLineNos []int // input line number of each kept line
+	kept := 0
+	invalid := 0 // lines whose key fails --validate-key
+	for lineNo := skipped + 1; scanner.Scan(); lineNo++ {
+		// Counted before any filter, so --output-stats reports every
+		// input line.
+		if sorter.stats != nil {
+			sorter.stats.linesRead++
+		}
+		// Trimmed before sorting, so -u treats " foo " and "foo" as
+		// duplicates.
+		line := filter.trim(scanner.Text())
+		if o.sortToLine >= 0 && lineNo > o.sortToLine {
+			tail = append(tail, line)
+			continue
+		}
+		if !filter.keep(line) {
+			continue
+		}
+		if exclude != nil && exclude.contains(sorter.comparedKey(line)) {
+			continue
+		}
+		if include != nil && !include.contains(sorter.comparedKey(line)) {
+			continue
+		}
+		if o.validateRe != nil {
+			if key := sorter.comparedKey(line); key != "" && !o.validateRe.MatchString(key) {
+				invalid++
+				if o.verbose {
+					fmt.Fprintf(stderr, "line %d: invalid key %q\n", lineNo, key)
+				}
+				if o.excludeInvalid {
+					continue
 				}
 			}
-			lines = uniqLines
 		}
-		for _, line := range lines {
-			fmt.Println(line)
+		if numbered {
+			keptLineNos = append(keptLineNos, lineNo)
 		}
+		if o.filterRe != nil && !o.filterRe.MatchString(line) {
+			pinned = append(pinned, pinnedLine{kept, line})
+			kept++
+			continue
+		}
+		switch {
+		case sample != nil:
+			sample.add(line, kept)
+		case o.filterRe != nil:
+			lines = append(lines, line)
+			positions = append(positions, kept)
+		default:
+			lines = append(lines, line)
+		}
+		kept++
+	}
+	if sample != nil {
+		lines, positions = sample.lines, sample.positions
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if invalid > 0 {
+		fmt.Fprintf(stderr, "Warning: %d lines have keys not matching --validate-key\n", invalid)
+	}
+	if err := waitPreSort(); err != nil {
+		return err
+	}
+	if len(lines) == 0 && o.errorOnEmpty {
+		return errors.New("input is empty")
+	}
+	if !o.noKeyWarnings {
+		warnEmptyKeys(lines, sorter, stderr)
+	}
+	var lineNos []int
+	if numbered {
+		lineNos = make([]int, len(lines))
+		for i := range lines {
+			pos := i
+			if positions != nil {
+				pos = positions[i]
+			}
+			lineNos[i] = keptLineNos[pos]
+		}
+	}
+	if o.strictNumeric != "" {
+		if err := checkNumericKeys(lines, lineNos, sorter, o.strictNumeric); err != nil {
+			return err
+		}
+	}
+	if o.strictMonth {
+		if err := checkMonthKeys(lines, lineNos, sorter); err != nil {
+			return err
+		}
+	}
+	if o.strict && o.order != nil {
+		if err := checkOrderKeys(lines, lineNos, sorter); err != nil {
+			return err
+		}
+	}
+
+	var sorted []string
+	var order []int
+	if o.groupBy != nil {
+		sorted, order = sorter.sortGroups(lines, o.groupBy, dedup)
+	} else {
+		sorted, order = sorter.sortIndexed(lines, dedup)
+	}
+	for i := range order {
+		if positions != nil {
+			order[i] = positions[order[i]]
+		}
+		order[i] += skipped
+	}
+	if o.uniqueKey != nil {
+		sorted, order = uniqueByKey(sorted, order, o.uniqueKey, o.blanks, o.foldCase)
+	}
+	if o.inverseSort {
+		sorted, order = inversePermutation(sorted, order)
+	}
+	if o.collisionLog != "" {
+		if err := logKeyCollisions(o.collisionLog, sorted, sorter, o.collisionSkipEmpty); err != nil {
+			return err
+		}
+	}
+	if o.keyPositionMap != "" {
+		if err := writeKeyPositions(o.keyPositionMap, sorted, sorter); err != nil {
+			return err
+		}
+	}
+	if o.maxUniqueKeys > 0 && len(sorted) > o.maxUniqueKeys {
+		if o.strict {
+			return fmt.Errorf("%d unique lines exceed --max-unique-keys %d", len(sorted), o.maxUniqueKeys)
+		}
+		fmt.Fprintf(stderr, "Warning: %d unique lines exceed --max-unique-keys %d\n", len(sorted), o.maxUniqueKeys)
+	}
+	// The checks and logs above see every line; only the output is paged.
+	if o.outputLimit >= 0 || o.outputOffset > 0 {
+		sorted, order = pageLines(sorted, order, o.outputOffset, o.outputLimit)
+	}
+	if o.explain {
+		explainOrder(stderr, sorter, sorted, order, o.explainLimit)
+	}
+	switch {
+	case o.chunkLines > 0:
+		err = writeChunks(sorted, o.chunkLines, o.chunkPrefix, o.delims.out)
+		if err == nil && sorter.stats != nil {
+			sorter.stats.linesWritten += len(sorted)
+		}
+	case o.splitTarget != "":
+		var n int
+		if n, err = splitByKey(sorted, sorter, o.splitTarget, o.delims.out); err == nil {
+			fmt.Fprintf(stderr, "%d files written\n", n)
+			if sorter.stats != nil {
+				sorter.stats.linesWritten += len(sorted)
+			}
+		}
+	default:
+		if o.align {
+			right := 0
+			if field, ok := sorter.extractor.(fieldKey); ok && sorter.numeric {
+				right = field.column
+			}
+			lw.align = newAligner(sorted, o.separator, o.quote, right)
+		}
+		next := 0 // next pinned line
+		for i, line := range sorted {
+			for ; err == nil && next < len(pinned) && pinned[next].pos <= i+next; next++ {
+				err = lw.writeRaw(pinned[next].line)
+			}
+			if err != nil {
+				break
+			}
+			if o.printPositions {
+				err = lw.writeRaw(fmt.Sprintf("%d\t%d", i+1, order[i]+1))
+			} else {
+				err = lw.writeIndexed(line, order[i])
+			}
+			if err != nil {
+				break
+			}
+		}
+		for ; err == nil && next < len(pinned); next++ {
+			err = lw.writeRaw(pinned[next].line)
+		}
+		for i := 0; err == nil && i < len(tail); i++ {
+			err = lw.writeRaw(tail[i])
+		}
+		if err == nil {
+			err = lw.flush()
+		}
+		err = finishOutput(err, waitPostSort, o.postSortCommand)
+	}
+	if err != nil {
+		return err
+	}
+	reportUnique(o, sorter.stats, stderr)
+	if len(lines) == 0 && o.passthroughOnEmpty {
+		return &exitError{code: 2}
+	}
+	return nil
+}
+
+// pinnedLine is a line that --filter leaves at its input position pos,
+// counted among the lines that pass the input filters.
+type pinnedLine struct {
+	pos  int
+	line string
+}
+
+// finishOutput combines the error from writing the output with the
+// outcome of the --post-sort-command, if any. A command that stops reading
+// early (head) breaks the pipe; that is not an error of ours.
+func finishOutput(err error, waitPostSort func() error, command string) error {
+	if command == "" {
+		return err
+	}
+	if brokenPipe(err) {
+		err = nil
+	}
+	if cmdErr := postSortResult(waitPostSort(), command); err == nil {
+		err = cmdErr
+	}
+	return err
+}
+
+// reportUnique prints the --report-unique summary line.
+func reportUnique(o *options, stats *sortStats, w io.Writer) {
+	if o.reportUnique && o.unique {
+		fmt.Fprintf(w, "unique: kept=%d removed=%d\n", stats.linesKept, stats.linesRemoved)
 	}
 }
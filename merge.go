@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// mergeFiles reduces files to at most limit names by merging each run of
+// limit files into a temporary file with merge, repeating on the results
+// until few enough remain. The returned cleanup removes the temporary
+// files and must be called even when an error is returned; a signal
+// before that removes them too.
+func mergeFiles(files []string, limit int, merge func(w io.Writer, group []string) error) ([]string, func(), error) {
+	temps := &tempFiles{}
+	var reduce func(files []string) ([]string, error)
+	reduce = func(files []string) ([]string, error) {
+		if len(files) <= limit {
+			return files, nil
+		}
+		merged := []string{}
+		for start := 0; start < len(files); start += limit {
+			end := start + limit
+			if end > len(files) {
+				end = len(files)
+			}
+			if end-start == 1 {
+				merged = append(merged, files[start])
+				continue
+			}
+			f, err := temps.create("gosort-merge-*")
+			if err != nil {
+				return nil, err
+			}
+			err = merge(f, files[start:end])
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, f.Name())
+		}
+		return reduce(merged)
+	}
+	names, err := reduce(files)
+	return names, temps.removeAll, err
+}
+
+// mergeGroup is one intermediate pass of mergeFiles: it merges the named
+// inputs into w using the input record delimiter, so the result can be
+// read back by a later pass.
+func mergeGroup(w io.Writer, o *options, names []string, stdin io.Reader, stderr io.Writer) error {
+	readers, closeInputs, err := openInputs(names, stdin, o.timeout)
+	if err != nil {
+		return err
+	}
+	defer closeInputs()
+	if o.detectEncoding {
+		for i, r := range readers {
+			readers[i] = detectEncoding(r)
+		}
+	}
+	cfg := newMergeConfig(o, names, stderr)
+	cfg.delims.out = cfg.delims.in
+	cfg.lineBuffered = false
+	return mergeError(mergeReaders(w, newSorter(o), cfg, readers...), names)
+}
+
+// newMergeConfig returns the merge settings selected by o. In loose mode
+// disorder warnings name the input from names and go to stderr.
+func newMergeConfig(o *options, names []string, stderr io.Writer) mergeConfig {
+	return mergeConfig{
+		dedup:        newDedupConfig(o),
+		delims:       o.delims,
+		loose:        o.mergeMode == "loose",
+		lineBuffered: o.lineBuffered,
+		warn: func(e *mergeOrderError) {
+			fmt.Fprintf(stderr, "Warning: %s: line %d: disorder: %s\n", names[e.index], e.line, e.text)
+		},
+	}
+}
+
+// mergeError names the failing input of a merge error after names. Input
+// that is not sorted is a usage error and exits with status 2.
+func mergeError(err error, names []string) error {
+	var readErr *mergeReadError
+	if errors.As(err, &readErr) {
+		return fmt.Errorf("%s: %v", names[readErr.index], readErr.err)
+	}
+	var orderErr *mergeOrderError
+	if errors.As(err, &orderErr) {
+		return &exitError{code: 2, err: fmt.Errorf("%s: line %d: disorder: %s", names[orderErr.index], orderErr.line, orderErr.text)}
+	}
+	return err
+}
+
+// mergeReadError reports a read failure of one of the merged inputs.
+type mergeReadError struct {
+	index int // position of the failing reader in the merge arguments
+	err   error
+}
+
+func (e *mergeReadError) Error() string {
+	return fmt.Sprintf("merge input %d: %v", e.index+1, e.err)
+}
+
+func (e *mergeReadError) Unwrap() error { return e.err }
+
+// mergeOrderError reports that a merged input was not sorted: its line
+// number line, text, sorts before the line preceding it.
+type mergeOrderError struct {
+	index int // position of the unsorted reader in the merge arguments
+	line  int
+	text  string
+}
+
+func (e *mergeOrderError) Error() string {
+	return fmt.Sprintf("merge input %d: line %d: disorder: %s", e.index+1, e.line, e.text)
+}
+
+// mergeConfig holds the settings of one merge.
+type mergeConfig struct {
+	dedup  dedupConfig // lines are dropped as duplicates with dedup.unique
+	delims recordDelims
+	// loose makes unsorted input a warning: disorder is passed to warn
+	// and the merge goes on, instead of failing with a *mergeOrderError.
+	loose bool
+	warn  func(*mergeOrderError)
+	// lineBuffered flushes the output after every merged line.
+	lineBuffered bool
+}
+
+// mergeSource is one pre-sorted input taking part in a merge.
+type mergeSource struct {
+	scanner *bufio.Scanner
+	line    string
+	index   int
+	lineNo  int // number of lines read so far
+}
+
+// mergeHeap orders merge sources by their current line.
+type mergeHeap struct {
+	sources []*mergeSource
+	sorter  byKey
+}
+
+func (h *mergeHeap) Len() int { return len(h.sources) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.sources[i], h.sources[j]
+	if h.sorter.less(a.line, b.line) {
+		return true
+	}
+	if h.sorter.less(b.line, a.line) {
+		return false
+	}
+	return a.index < b.index
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.sources[i], h.sources[j] = h.sources[j], h.sources[i] }
+
+func (h *mergeHeap) Push(x any) { h.sources = append(h.sources, x.(*mergeSource)) }
+
+func (h *mergeHeap) Pop() any {
+	last := h.sources[len(h.sources)-1]
+	h.sources = h.sources[:len(h.sources)-1]
+	return last
+}
+
+// advance reads the next line of src, reporting false at EOF. A line
+// that sorts before its predecessor is reported to cfg.
+func (src *mergeSource) advance(sorter byKey, cfg mergeConfig) (bool, error) {
+	if src.scanner.Scan() {
+		if sorter.stats != nil {
+			sorter.stats.linesRead++
+		}
+		prev := src.line
+		src.line = src.scanner.Text()
+		src.lineNo++
+		if src.lineNo > 1 && sorter.less(src.line, prev) {
+			disorder := &mergeOrderError{src.index, src.lineNo, src.line}
+			if !cfg.loose {
+				return false, disorder
+			}
+			if cfg.warn != nil {
+				cfg.warn(disorder)
+			}
+		}
+		return true, nil
+	}
+	if err := src.scanner.Err(); err != nil {
+		return false, &mergeReadError{src.index, err}
+	}
+	return false, nil
+}
+
+// mergeReaders performs a k-way merge of readers, each already sorted
+// under the sorter's settings, and writes the result to w. Equal lines
+// are taken from earlier readers first. With cfg.dedup.unique set, lines
+// that duplicate the previously written one are dropped. Every input is
+// checked to be sorted as it is consumed.
+func mergeReaders(w io.Writer, sorter byKey, cfg mergeConfig, readers ...io.Reader) error {
+	delims := cfg.delims
+	h := &mergeHeap{sorter: sorter}
+	for i, r := range readers {
+		src := &mergeSource{scanner: newLineScanner(r, delims.in), index: i}
+		ok, err := src.advance(sorter, cfg)
+		if err != nil {
+			return err
+		}
+		if ok {
+			h.sources = append(h.sources, src)
+		}
+	}
+	heap.Init(h)
+
+	bw := bufio.NewWriter(w)
+	written := false
+	last := ""
+	for h.Len() > 0 {
+		src := h.sources[0]
+		if !cfg.dedup.unique || !written || !sorter.duplicates(cfg.dedup, src.line, last) {
+			if sorter.stats != nil {
+				sorter.stats.linesWritten++
+				if cfg.dedup.unique {
+					sorter.stats.linesKept++
+				}
+			}
+			bw.WriteString(src.line)
+			bw.WriteByte(delims.out)
+			last = src.line
+			written = true
+			if cfg.lineBuffered {
+				if err := bw.Flush(); err != nil {
+					return err
+				}
+			}
+		} else if sorter.stats != nil {
+			sorter.stats.linesRemoved++
+		}
+		ok, err := src.advance(sorter, cfg)
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return bw.Flush()
+}
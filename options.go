@@ -0,0 +1,810 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf8"
+)
+
+// options holds the parsed command line.
+type options struct {
+	column             int
+	separator          string
+	numeric            bool
+	reverse            bool
+	unique             bool
+	month              bool
+	blanks             bool
+	check              bool
+	human              bool
+	follow             bool
+	flushInterval      time.Duration
+	flushMarker        string
+	minCount           int
+	maxCount           int
+	splitTarget        string
+	noKeyWarnings      bool
+	chunkLines         int
+	chunkPrefix        string
+	outputStats        bool
+	columnRange        string
+	preSortCommand     string
+	postSortCommand    string
+	byteOffset         int
+	byteLength         int
+	removeBlank        bool
+	commentPrefix      string
+	verbose            bool
+	merge              bool
+	globs              stringList
+	globNoMatch        string
+	stableOutput       bool
+	preserveInputOrder bool // lines with equal keys appear in the same relative order as in the input
+	showKeys           bool
+	fieldMapping       string
+	keysOnly           bool
+	lastField          bool
+	zeroTerminated     bool
+	nulDataInput       bool
+	nulDataOutput      bool
+	reportUnique       bool
+	formatOutput       string
+	uniqueNormalized   bool
+	detectEncoding     bool
+	checkDupesOnly     bool
+	explain            bool
+	explainLimit       int
+	sortGroups         int
+	mergeLimit         int
+	paths              bool
+	stableIndex        bool
+	domain             bool
+	email              bool
+	dedupAdjacent      bool
+	url                string
+	byEntropy          bool
+	byDistance         string
+	byJaroWinkler      string
+	byNumericPrefix    bool
+	uuid               string
+	extractNumber      bool
+	fieldCompute       string
+	orderFile          string
+	strict             bool
+	byChecksum         string
+	checksumSeed       uint
+	passthroughOnEmpty bool
+	errorOnEmpty       bool
+	alphabet           string
+	wordWrap           int
+	wrapIndent         string
+	foldCase           bool
+	foldThenExact      bool
+	sortFromLine       int
+	mergeMode          string
+	sortToLine         int
+	keyLengthLimit     int
+	uniqueApprox       string
+	uniqueApproxSize   int
+	separatorAtEnd     bool
+	maxUniqueKeys      int
+	monthYear          bool
+	strictMonth        bool
+	strictNumeric      string
+	randomSubset       int
+	randomSeed         int64
+	filterPattern      string
+	printPositions     bool
+	keySubs            stringList
+	keyTransforms      stringList
+	collisionLog       string
+	inverseSort        bool
+	keyMap             string
+	trimOutput         bool
+	trimOutputLeft     bool
+	trimOutputRight    bool
+	timeout            time.Duration
+	outputSeparator    string
+	keyPositionMap     string
+	projectSpec        string
+	byCount            bool
+	byCountDesc        bool
+	lineBuffered       bool
+	fieldQuoteChar     string
+	cpuProfile         string
+	memProfile         string
+	validateKey        string
+	excludeInvalid     bool
+	excludeFile        string
+	includeFile        string
+	raw                bool
+	uniqueKeyColumn    int
+	uniqueKeyLast      bool
+	align              bool
+	outputLimit        int // --head-count/--output-limit, -1 for all lines
+	outputOffset       int
+	collisionSkipEmpty bool
+	numberIndex        int
+	headerFile         string
+	headerCount        int
+	sortWithin         int
+
+	replacements []keyReplacement
+	delims       recordDelims
+	extractor    keyExtractor
+	groupBy      keyExtractor   // --sort-groups field, or nil
+	order        map[string]int // keys listed in --order-file, by position
+	approxRate   float64        // parsed --unique-approx false-positive rate
+	alphabetRank map[rune]int   // characters listed in --alphabet, by position
+	filterRe     *regexp.Regexp // compiled --filter, or nil
+	validateRe   *regexp.Regexp // compiled --validate-key, or nil
+	uniqueKey    keyExtractor   // --unique-key field, or nil
+	keyMapSteps  []func(string) string
+	fieldMap     []int
+	project      []int // parsed --project
+	quote        byte  // --field-quote-char, or 0
+	format       *template.Template
+	files        []string
+}
+
+// parseOptions parses and validates the command line arguments (without
+// the program name). Flag syntax errors are reported on stderr by the
+// flag package and returned as an exitError with code 2.
+func parseOptions(args []string, stderr io.Writer) (*options, error) {
+	o := &options{}
+	args, replacements, err := extractReplaceArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	o.replacements = replacements
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	key := keyColumn{&o.column, &o.lastField}
+	fs.Var(key, "k", "sort by column `N` (1-based, default whole line), or by the last field with \"last\"")
+	fs.Var(key, "key", "same as -k")
+	fs.StringVar(&o.separator, "t", "\t", "field separator for -k; \" \" splits on runs of blanks, \"\" on every character")
+	fs.BoolVar(&o.numeric, "n", false, "sort by numerical value")
+	fs.BoolVar(&o.reverse, "r", false, "sort in reverse order")
+	fs.BoolVar(&o.unique, "u", false, "output unique lines only")
+	fs.BoolVar(&o.month, "M", false, "sort by month name")
+	fs.BoolVar(&o.monthYear, "month-year", false, "like -M, but compare a four-digit year after the month name first (\"Mar 2023\"); keys without one sort last, by month")
+	fs.Var(optionalValue{&o.strictNumeric, "number", []string{"number", "trailing"}}, "strict-numeric", "with -n or -h, exit with status 2 at the first key that holds no number; =trailing also rejects text after the number")
+	fs.BoolVar(&o.strictMonth, "strict-month", false, "with -M, exit with status 2 at the first key that is no month name")
+	fs.BoolVar(&o.foldCase, "f", false, "fold lower case to upper case characters when comparing")
+	fs.BoolVar(&o.foldThenExact, "fold-then-exact", false, "like -f, but order keys that differ only in case by their exact bytes")
+	fs.BoolVar(&o.domain, "domain", false, "compare keys as host names by their labels right to left, ignoring case")
+	fs.BoolVar(&o.email, "email", false, "compare keys as email addresses: domain first (as with --domain), then the case-sensitive local part")
+	fs.Var(optionalValue{&o.url, "plain", []string{"plain", "normalize"}}, "url", "compare keys as URLs by host, path, then query; =normalize also treats scheme and fragment differences as equal for -u")
+	fs.BoolVar(&o.byEntropy, "by-entropy", false, "sort by the Shannon entropy of the key's bytes, lowest first")
+	fs.BoolVar(&o.byNumericPrefix, "by-numeric-prefix", false, "sort by the key's leading integer (0 if none), then by the text after it")
+	fs.StringVar(&o.byJaroWinkler, "by-jaro-winkler", "", "sort by Jaro-Winkler similarity of the key to `REFERENCE`, most similar first")
+	fs.StringVar(&o.byDistance, "by-distance", "", "sort by Levenshtein edit distance of the key from `REFERENCE`, nearest first")
+	fs.Var(optionalValue{&o.uuid, "value", []string{"value", "time"}}, "uuid", "compare keys as UUIDs by 128-bit value; =time orders v1 and v7 UUIDs by their timestamp")
+	fs.BoolVar(&o.extractNumber, "extract-number", false, "sort numerically by the first number found anywhere in the key")
+	fs.IntVar(&o.numberIndex, "number-index", 1, "with --extract-number, use the Nth number instead; negative counts from the end (-1 = last)")
+	fs.StringVar(&o.fieldCompute, "field-compute", "", "sort numerically by the value of EXPR over the fields, e.g. \"$2 * $3\" (+ - * / and parentheses)")
+	fs.StringVar(&o.orderFile, "order-file", "", "rank keys by their position in FILE (one per line, # comments); unlisted keys go last")
+	fs.BoolVar(&o.strict, "strict", false, "make --order-file and --max-unique-keys problems errors instead of warnings or fallbacks")
+	fs.StringVar(&o.byChecksum, "by-checksum", "", "sort by the ALGO checksum of the key: crc32, adler32, sha1 or md5")
+	fs.UintVar(&o.checksumSeed, "checksum-seed", 0, "with --by-checksum crc32, use this polynomial instead of IEEE")
+	fs.StringVar(&o.alphabet, "alphabet", "", "compare characters by their order in FILE (characters or X-Y ranges); unlisted ones go last")
+	fs.BoolVar(&o.paths, "paths", false, "compare keys as paths, component by component, so a directory's entries stay together")
+	fs.BoolVar(&o.blanks, "b", false, "ignore trailing blanks")
+	fs.BoolVar(&o.check, "c", false, "check if data is sorted")
+	fs.BoolVar(&o.human, "h", false, "sort by human-readable numeric value")
+	fs.BoolVar(&o.follow, "follow", false, "keep reading and print sorted batches without waiting for EOF")
+	fs.DurationVar(&o.flushInterval, "flush-interval", time.Second, "with --follow, flush the current batch this often (0 disables)")
+	fs.StringVar(&o.flushMarker, "flush-marker", "", "with --follow, flush the current batch when this line is read")
+	fs.IntVar(&o.minCount, "min-count", 0, "with -u, omit lines that appear fewer than N times")
+	fs.IntVar(&o.maxCount, "max-count", 0, "with -u, omit lines that appear more than N times")
+	fs.StringVar(&o.splitTarget, "split-by-key", "", "write each key's lines to its own file in DIR (or a path template containing {key})")
+	fs.BoolVar(&o.noKeyWarnings, "no-key-warnings", false, "do not warn when the -k field is empty for most lines")
+	fs.IntVar(&o.chunkLines, "chunk-lines", 0, "write the output into files of N lines each (see --chunk-prefix)")
+	fs.StringVar(&o.chunkPrefix, "chunk-prefix", "out", "path prefix for --chunk-lines files, numbered PREFIX.000, PREFIX.001, ...")
+	fs.BoolVar(&o.outputStats, "output-stats", false, "print sort statistics to stderr when done")
+	fs.StringVar(&o.columnRange, "column-range", "", "sort by characters START,END of the line (1-based, inclusive)")
+	fs.StringVar(&o.preSortCommand, "pre-sort-command", "", "pipe the input through shell command CMD before sorting")
+	fs.StringVar(&o.postSortCommand, "post-sort-command", "", "pipe the sorted output through shell command CMD")
+	fs.IntVar(&o.byteOffset, "byte-offset", 0, "with --byte-length, take the key from this 0-based byte offset")
+	fs.IntVar(&o.byteLength, "byte-length", 0, "sort by N raw bytes of each line, compared bytewise")
+	fs.BoolVar(&o.removeBlank, "remove-blank-lines", false, "discard empty lines while reading")
+	fs.StringVar(&o.commentPrefix, "remove-comment-lines", "", "discard lines starting with PREFIX while reading")
+	fs.BoolVar(&o.verbose, "verbose", false, "report details such as removed line counts on stderr")
+	fs.BoolVar(&o.merge, "m", false, "merge already sorted files")
+	fs.Var(optionalValue{&o.mergeMode, "strict", []string{"strict", "loose"}}, "merge", "like -m; an unsorted input fails with status 2, or with =loose only warns")
+	fs.IntVar(&o.mergeLimit, "merge-limit", defaultMergeLimit(), "with -m, open at most N inputs at once, merging in several passes through temporary files")
+	fs.Var(&o.globs, "input-from-glob", "also read all files matching PATTERN, in sorted order (repeatable)")
+	fs.StringVar(&o.globNoMatch, "glob-no-match", "error", "what to do when an --input-from-glob pattern matches nothing: error or warn")
+	fs.BoolVar(&o.preserveInputOrder, "preserve-input-order", false, "sort stably: lines with equal keys appear in the same relative order as in the input")
+	fs.BoolVar(&o.stableOutput, "stable-output", false, "break ties between equal keys by comparing whole lines, so output does not depend on input order")
+	fs.BoolVar(&o.showKeys, "show-keys", false, "prefix each output line with its sort key and a tab")
+	fs.StringVar(&o.fieldMapping, "field-mapping", "", "print only the listed fields, e.g. 2,1,3 (0 = whole line), joined with the -t separator")
+	fs.BoolVar(&o.keysOnly, "keys-only", false, "print the sort key of each line instead of the line; -u then deduplicates keys")
+	fs.BoolVar(&o.lastField, "last-field", false, "sort by the last field of each line")
+	fs.BoolVar(&o.zeroTerminated, "z", false, "lines are terminated by NUL instead of newline, on input and output")
+	fs.BoolVar(&o.nulDataInput, "nul-data-input", false, "read NUL-terminated lines, write newline-terminated ones")
+	fs.BoolVar(&o.nulDataOutput, "nul-data-output", false, "read newline-terminated lines, write NUL-terminated ones")
+	fs.BoolVar(&o.reportUnique, "report-unique", false, "with -u, print \"unique: kept=N removed=M\" to stderr when done")
+	fs.StringVar(&o.formatOutput, "format-output", "", "print each line through Go template FMT with .Line, .Key and .Fields")
+	fs.BoolVar(&o.uniqueNormalized, "unique-normalized", false, "like -u, but lines differing only in blank runs or leading/trailing blanks are duplicates")
+	fs.BoolVar(&o.detectEncoding, "detect-encoding", false, "strip a UTF-8 BOM and decode UTF-16 input that starts with a BOM")
+	fs.BoolVar(&o.checkDupesOnly, "check-dupes-only", false, "exit 1 at the first line whose key was seen before, without requiring sorted input")
+	fs.BoolVar(&o.explain, "explain", false, "explain on stderr why adjacent output lines are in their order")
+	fs.IntVar(&o.explainLimit, "explain-limit", 10, "with --explain, explain at most N pairs (0 = all)")
+	fs.IntVar(&o.sortGroups, "sort-groups", 0, "partition lines by field N, keeping groups in input order (needs --sort-within)")
+	fs.IntVar(&o.sortWithin, "sort-within", 0, "with --sort-groups, sort the lines of each group by field N")
+	fs.BoolVar(&o.stableIndex, "stable-index", false, "prefix each output line with its 1-based input line number and a tab")
+	fs.StringVar(&o.headerFile, "header-file", "", "print the lines of FILE unsorted before the sorted output")
+	fs.IntVar(&o.headerCount, "header-count", 0, "with --header-file, use only the first N lines of FILE (0 = all)")
+	fs.BoolVar(&o.dedupAdjacent, "dedup-adjacent", false, "do not sort; drop lines whose key equals the previous line's, like uniq")
+	fs.BoolVar(&o.passthroughOnEmpty, "passthrough-on-empty", false, "exit with status 2 when the input has no lines")
+	fs.BoolVar(&o.errorOnEmpty, "error-on-empty", false, "fail with an error when the input has no lines")
+	fs.IntVar(&o.wordWrap, "word-wrap", 0, "wrap output lines longer than N characters at spaces")
+	fs.StringVar(&o.wrapIndent, "wrap-indent", "    ", "with --word-wrap, prefix continuation lines with this")
+	fs.IntVar(&o.sortFromLine, "sort-from-line", 0, "copy the first N lines through unchanged and sort only the rest")
+	fs.IntVar(&o.sortToLine, "sort-to-line", -1, "sort only lines up to line N and copy the rest through unchanged after them (0 = sort nothing)")
+	fs.IntVar(&o.keyLengthLimit, "key-length-limit", 0, "compare only the first N characters of each key; -u then keeps the first of lines whose truncated keys match")
+	fs.Var(optionalValue{&o.uniqueApprox, "0.001", nil}, "unique-approx", "do not sort; drop lines whose key was seen before, using a Bloom filter with this false-positive rate (=RATE, default 0.001); may drop rare non-duplicates")
+	fs.IntVar(&o.uniqueApproxSize, "unique-approx-size", 1<<16, "with --unique-approx, the expected number of distinct keys; the filter grows beyond it")
+	fs.BoolVar(&o.separatorAtEnd, "separator-at-end", false, "with --field-mapping, also write the separator after the last field")
+	fs.IntVar(&o.maxUniqueKeys, "max-unique-keys", 0, "with -u, warn (with --strict, fail) when more than N unique lines remain")
+	fs.IntVar(&o.randomSubset, "random-subset", 0, "sort a uniform random sample of K lines instead of all of them")
+	fs.Int64Var(&o.randomSeed, "random-seed", 0, "with --random-subset, seed the sample so it is reproducible (0 picks a random seed)")
+	fs.StringVar(&o.filterPattern, "filter", "", "sort only lines matching REGEX; other lines keep their positions")
+	fs.BoolVar(&o.printPositions, "print-positions", false, "instead of the lines, print each one's output rank and input line number, tab-separated")
+	fs.Var(&o.keySubs, "key-sub", "rewrite keys before comparing with sed-style s/PATTERN/REPL/[g] (repeatable, applied in order)")
+	fs.StringVar(&o.collisionLog, "key-collision-log", "", "write each pair of adjacent sorted lines with equal keys to FILE, pairs separated by a blank line")
+	fs.BoolVar(&o.collisionSkipEmpty, "collision-skip-empty", false, "with --key-collision-log, do not create FILE when there are no collisions")
+	fs.BoolVar(&o.inverseSort, "inverse-sort", false, "print the input rearranged by the inverse of the sort permutation")
+	fs.StringVar(&o.keyMap, "key-map", "", "transform keys before comparing, in order: comma-separated names as for --key-transform")
+	fs.Var(&o.keyTransforms, "key-transform", "transform keys before comparing with lower, upper, title, trim, squeeze, strip-punct, reverse-string or base64-encode (repeatable, applied in order after --key-map)")
+	fs.BoolVar(&o.trimOutput, "trim-output", false, "remove leading and trailing whitespace from each line; -u sees the trimmed lines")
+	fs.BoolVar(&o.trimOutputLeft, "trim-output-left", false, "remove leading whitespace from each line")
+	fs.BoolVar(&o.trimOutputRight, "trim-output-right", false, "remove trailing whitespace from each line")
+	fs.DurationVar(&o.timeout, "timeout", 0, "give up on an http:// or https:// input after this long (0 waits forever)")
+	fs.StringVar(&o.outputSeparator, "output-separator", "", "rejoin the -t fields of each output line with this separator")
+	fs.StringVar(&o.keyPositionMap, "key-position-map", "", "write a JSON object mapping each key to its first 1-based position in the output to this file")
+	fs.StringVar(&o.projectSpec, "project", "", "print only the listed fields after sorting, e.g. 1,3 or 2-5 (\"key\" = the sort key), joined with the output separator")
+	fs.BoolVar(&o.byCount, "by-count", false, "sort uniq -c output numerically by its leading count")
+	fs.BoolVar(&o.byCountDesc, "by-count-desc", false, "like --by-count -r: largest counts first")
+	fs.BoolVar(&o.lineBuffered, "line-buffered", false, "flush the output after every line (no effect when writing to a regular file)")
+	fs.StringVar(&o.fieldQuoteChar, "field-quote-char", "", "a field starting with this character runs to its next unescaped occurrence, separators included")
+	fs.StringVar(&o.validateKey, "validate-key", "", "warn about non-empty keys that do not match the regular expression `RE`; --verbose lists them")
+	fs.BoolVar(&o.excludeInvalid, "exclude-invalid", false, "with --validate-key, drop the lines whose keys do not match")
+	fs.StringVar(&o.excludeFile, "exclude-file", "", "drop lines whose key equals a line of `FILE`, which is read into memory")
+	fs.StringVar(&o.includeFile, "include-file", "", "keep only lines whose key equals a line of `FILE`, which is read into memory")
+	fs.Var(keyColumn{&o.uniqueKeyColumn, &o.uniqueKeyLast}, "unique-key", "after sorting, keep only the first line for each value of field `N` (or \"last\"); -f and -b apply")
+	fs.BoolVar(&o.raw, "raw", false, "compare keys as plain bytes, like memcmp, with no other comparison option")
+	fs.BoolVar(&o.align, "align", false, "pad the -t fields of the output into columns separated by two spaces; an -n key column is right-aligned")
+	o.outputLimit = -1
+	fs.Var(lineLimit{&o.outputLimit, false}, "head-count", "print only the first `N` sorted lines (0 prints none)")
+	limit := lineLimit{&o.outputLimit, true}
+	fs.Var(limit, "output-limit", "print at most `N` sorted lines, after --output-offset (0 prints all, unlike --head-count)")
+	fs.Var(limit, "L", "same as --output-limit")
+	fs.IntVar(&o.outputOffset, "output-offset", 0, "skip the first `M` sorted lines; with --output-limit N prints lines M+1 to M+N")
+	fs.StringVar(&o.cpuProfile, "cpuprofile", "", "write a CPU profile of the run to `FILE`")
+	fs.StringVar(&o.memProfile, "memprofile", "", "write a heap profile to `FILE` at the end of the run")
+	fs.Usage = func() { printUsage(fs, debugFlags) }
+	if err := fs.Parse(permuteArgs(fs, args)); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, err
+		}
+		return nil, &exitError{code: 2}
+	}
+	o.files = fs.Args()
+
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// recordDelims are the line terminators used for input and output.
+type recordDelims struct {
+	in  byte
+	out byte
+}
+
+// debugFlags are listed under their own heading in the -help text.
+var debugFlags = map[string]bool{"cpuprofile": true, "memprofile": true}
+
+// printUsage is the -help text: the flags as flag.PrintDefaults shows them,
+// with the debug ones in a section of their own at the end.
+func printUsage(fs *flag.FlagSet, debug map[string]bool) {
+	w := fs.Output()
+	general := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	debugging := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	general.SetOutput(w)
+	debugging.SetOutput(w)
+	fs.VisitAll(func(f *flag.Flag) {
+		set := general
+		if debug[f.Name] {
+			set = debugging
+		}
+		set.Var(f.Value, f.Name, f.Usage)
+		// The value may already be parsed; show the real default.
+		set.Lookup(f.Name).DefValue = f.DefValue
+	})
+	fmt.Fprintf(w, "Usage of %s:\n", fs.Name())
+	general.PrintDefaults()
+	fmt.Fprintf(w, "\nDebugging:\n")
+	debugging.PrintDefaults()
+}
+
+// validate rejects conflicting options and derives the key extractor.
+func (o *options) validate() error {
+	if o.uniqueNormalized {
+		o.unique = true
+	}
+	if o.mergeMode != "" {
+		o.merge = true
+	}
+	if o.trimOutput {
+		o.trimOutputLeft, o.trimOutputRight = true, true
+	}
+	// --by-count is -n on the leading count of uniq -c output.
+	if o.byCountDesc {
+		o.byCount, o.reverse = true, true
+	}
+	if o.byCount {
+		o.numeric = true
+	}
+	if (o.trimOutputLeft || o.trimOutputRight) && (o.check || o.merge || o.checkDupesOnly) {
+		return errors.New("--trim-output, --trim-output-left and --trim-output-right cannot be combined with check, -m or --check-dupes-only mode")
+	}
+	if o.keyMap != "" {
+		steps, err := parseKeyTransforms("--key-map", strings.Split(o.keyMap, ","))
+		if err != nil {
+			return err
+		}
+		o.keyMapSteps = steps
+	}
+	if len(o.keyTransforms) > 0 {
+		steps, err := parseKeyTransforms("--key-transform", o.keyTransforms)
+		if err != nil {
+			return err
+		}
+		o.keyMapSteps = append(o.keyMapSteps, steps...)
+	}
+	for _, expr := range o.keySubs {
+		rep, err := parseKeySub(expr)
+		if err != nil {
+			return err
+		}
+		o.replacements = append(o.replacements, rep)
+	}
+	if o.foldThenExact {
+		o.foldCase = true
+	}
+	if o.monthYear {
+		o.month = true
+	}
+	o.delims = recordDelims{'\n', '\n'}
+	if o.zeroTerminated || o.nulDataInput {
+		o.delims.in = 0
+	}
+	if o.zeroTerminated || o.nulDataOutput {
+		o.delims.out = 0
+	}
+	modes := o.comparisonModes()
+	if len(modes) > 1 {
+		return fmt.Errorf("%s cannot be combined with %s: both choose how keys compare", modes[1], modes[0])
+	}
+	if o.strictNumeric != "" && !o.numeric && !o.human {
+		return errors.New("--strict-numeric requires -n or -h")
+	}
+	if o.strictNumeric != "" && (o.check || o.merge || o.follow || o.checkDupesOnly) {
+		return errors.New("--strict-numeric cannot be combined with check, -m, --follow or --check-dupes-only mode")
+	}
+	if o.strictMonth && !o.month {
+		return errors.New("--strict-month requires -M")
+	}
+	if o.strictMonth && (o.check || o.merge || o.follow || o.checkDupesOnly) {
+		return errors.New("--strict-month cannot be combined with check, -m, --follow or --check-dupes-only mode")
+	}
+	if (o.minCount > 0 || o.maxCount > 0) && !o.unique {
+		return errors.New("--min-count and --max-count require -u")
+	}
+	if (o.minCount > 0 || o.maxCount > 0) && o.merge {
+		return errors.New("--min-count and --max-count cannot be combined with -m")
+	}
+	if o.splitTarget != "" && (o.check || o.follow) {
+		return errors.New("--split-by-key cannot be combined with check or --follow mode")
+	}
+	if o.splitTarget != "" && (o.showKeys || o.keysOnly || o.fieldMapping != "" || o.formatOutput != "" || o.projectSpec != "" || o.outputSeparator != "" || o.wordWrap > 0) {
+		return errors.New("--split-by-key writes the lines unchanged and cannot be combined with output formatting options")
+	}
+	if o.chunkLines < 0 {
+		return errors.New("--chunk-lines must be positive")
+	}
+	if o.chunkLines > 0 && (o.check || o.follow || o.splitTarget != "") {
+		return errors.New("--chunk-lines cannot be combined with check, --follow or --split-by-key mode")
+	}
+	if o.chunkLines > 0 && (o.showKeys || o.keysOnly || o.fieldMapping != "" || o.formatOutput != "" || o.projectSpec != "" || o.outputSeparator != "" || o.wordWrap > 0) {
+		return errors.New("--chunk-lines writes the lines unchanged and cannot be combined with output formatting options")
+	}
+	if o.fieldQuoteChar != "" {
+		if len(o.fieldQuoteChar) != 1 || o.fieldQuoteChar[0] >= utf8.RuneSelf {
+			return fmt.Errorf("--field-quote-char must be a single ASCII character, not %q", o.fieldQuoteChar)
+		}
+		if o.separator == "" || strings.Contains(o.separator, o.fieldQuoteChar) {
+			return errors.New("--field-quote-char needs a -t separator that does not contain it")
+		}
+		o.quote = o.fieldQuoteChar[0]
+	}
+	if o.column > 0 {
+		o.extractor = fieldKey{o.column, o.separator, o.quote}
+	}
+	if o.columnRange != "" {
+		if o.column > 0 {
+			return errors.New("cannot combine -k and --column-range")
+		}
+		start, end, err := parseColumnRange(o.columnRange)
+		if err != nil {
+			return err
+		}
+		o.extractor = charRangeKey{start, end}
+	}
+	if o.lastField {
+		if o.column > 0 || o.columnRange != "" {
+			return errors.New("--last-field cannot be combined with -k or --column-range")
+		}
+		o.extractor = lastFieldKey{o.separator, o.quote}
+	}
+	if o.postSortCommand != "" && (o.check || o.chunkLines > 0 || o.splitTarget != "") {
+		return errors.New("--post-sort-command cannot be combined with check, --chunk-lines or --split-by-key mode")
+	}
+	if o.byteOffset < 0 || o.byteLength < 0 {
+		return errors.New("--byte-offset and --byte-length must not be negative")
+	}
+	if o.byteOffset > 0 && o.byteLength == 0 {
+		return errors.New("--byte-offset requires --byte-length")
+	}
+	if o.byteLength > 0 && (o.column > 0 || o.columnRange != "" || o.lastField) {
+		return errors.New("--byte-length cannot be combined with another key option")
+	}
+	if o.byteLength > 0 {
+		o.extractor = byteRangeKey{o.byteOffset, o.byteLength}
+	}
+	if o.merge && (o.check || o.follow || o.chunkLines > 0 || o.splitTarget != "" || o.preSortCommand != "") {
+		return errors.New("-m cannot be combined with check, --follow, --chunk-lines, --split-by-key or --pre-sort-command")
+	}
+	if o.mergeLimit < 2 {
+		return errors.New("--merge-limit must be at least 2")
+	}
+	if o.merge && o.outputSeparator != "" {
+		return errors.New("--output-separator cannot be combined with -m")
+	}
+	if o.merge && (o.removeBlank || o.commentPrefix != "") {
+		return errors.New("--remove-blank-lines and --remove-comment-lines cannot be combined with -m")
+	}
+	if o.globNoMatch != "error" && o.globNoMatch != "warn" {
+		return fmt.Errorf("invalid --glob-no-match %q: want error or warn", o.globNoMatch)
+	}
+	if o.showKeys && (o.check || o.merge) {
+		return errors.New("--show-keys cannot be combined with check or -m mode")
+	}
+	if o.fieldMapping != "" {
+		if o.check || o.merge {
+			return errors.New("--field-mapping cannot be combined with check or -m mode")
+		}
+		fieldMap, err := parseFieldMapping(o.fieldMapping)
+		if err != nil {
+			return err
+		}
+		o.fieldMap = fieldMap
+	}
+	if o.projectSpec != "" {
+		if o.check || o.merge || o.fieldMapping != "" || o.keysOnly {
+			return errors.New("--project cannot be combined with check or -m mode, --field-mapping or --keys-only")
+		}
+		project, err := parseProjection(o.projectSpec)
+		if err != nil {
+			return err
+		}
+		o.project = project
+	}
+	if o.keysOnly && (o.check || o.merge || o.showKeys || o.fieldMapping != "") {
+		return errors.New("--keys-only cannot be combined with check or -m mode, --show-keys or --field-mapping")
+	}
+	if o.reportUnique && (o.check || o.merge) {
+		return errors.New("--report-unique cannot be combined with check or -m mode")
+	}
+	if o.formatOutput != "" {
+		if o.check || o.merge || o.keysOnly || o.fieldMapping != "" {
+			return errors.New("--format-output cannot be combined with check or -m mode, --keys-only or --field-mapping")
+		}
+		tmpl, err := template.New("format-output").Parse(o.formatOutput)
+		if err != nil {
+			return fmt.Errorf("invalid --format-output template: %v", err)
+		}
+		o.format = tmpl
+	}
+	if o.checkDupesOnly && (o.check || o.merge || o.follow) {
+		return errors.New("--check-dupes-only cannot be combined with check, -m or --follow mode")
+	}
+	if (o.sortGroups > 0) != (o.sortWithin > 0) {
+		return errors.New("--sort-groups and --sort-within must be given together")
+	}
+	if o.sortGroups > 0 {
+		if o.extractor != nil {
+			return errors.New("--sort-groups cannot be combined with -k, --column-range, --last-field or --byte-length")
+		}
+		if o.check || o.merge || o.follow || o.checkDupesOnly {
+			return errors.New("--sort-groups cannot be combined with check, -m, --follow or --check-dupes-only mode")
+		}
+		o.groupBy = fieldKey{o.sortGroups, o.separator, o.quote}
+		o.extractor = fieldKey{o.sortWithin, o.separator, o.quote}
+	}
+	if o.fieldCompute != "" {
+		if o.extractor != nil {
+			return errors.New("--field-compute cannot be combined with another key option")
+		}
+		e, err := parseExpr(o.fieldCompute)
+		if err != nil {
+			return fmt.Errorf("invalid --field-compute expression: %v", err)
+		}
+		o.numeric = true
+		o.extractor = computedKey{e, o.separator, o.quote}
+	}
+	if o.byCount {
+		if o.extractor != nil || o.fieldCompute != "" {
+			return errors.New("--by-count cannot be combined with another key option")
+		}
+		o.extractor = fieldKey{1, " ", 0}
+	}
+	if o.checksumSeed != 0 && o.byChecksum == "" {
+		return errors.New("--checksum-seed requires --by-checksum")
+	}
+	if o.checksumSeed > math.MaxUint32 {
+		return errors.New("--checksum-seed must fit in 32 bits")
+	}
+	if o.byChecksum != "" {
+		key, err := newChecksumKey(o.extractor, o.byChecksum, uint32(o.checksumSeed))
+		if err != nil {
+			return err
+		}
+		o.extractor = key
+	}
+	if o.numberIndex != 1 && !o.extractNumber {
+		return errors.New("--number-index requires --extract-number")
+	}
+	if o.extractNumber {
+		if o.numberIndex == 0 {
+			return errors.New("--number-index must not be 0")
+		}
+		o.numeric = true
+		o.extractor = numberKey{o.extractor, o.numberIndex}
+	}
+	if o.stableIndex && (o.check || o.merge || o.follow || o.checkDupesOnly || o.chunkLines > 0 || o.splitTarget != "") {
+		return errors.New("--stable-index cannot be combined with check, -m, --follow, --check-dupes-only, --chunk-lines or --split-by-key mode")
+	}
+	if o.headerCount < 0 {
+		return errors.New("--header-count must not be negative")
+	}
+	if o.headerCount > 0 && o.headerFile == "" {
+		return errors.New("--header-count requires --header-file")
+	}
+	if o.headerFile != "" && (o.check || o.follow || o.checkDupesOnly || o.chunkLines > 0 || o.splitTarget != "") {
+		return errors.New("--header-file cannot be combined with check, --follow, --check-dupes-only, --chunk-lines or --split-by-key mode")
+	}
+	if o.dedupAdjacent && (len(modes) > 0 || o.reverse || o.unique || o.stableOutput ||
+		o.check || o.merge || o.follow || o.checkDupesOnly || o.chunkLines > 0 || o.splitTarget != "" || o.groupBy != nil || o.stableIndex || o.explain) {
+		return errors.New("--dedup-adjacent does not sort and cannot be combined with sort, -u or mode options")
+	}
+	if o.strict && o.orderFile == "" && o.maxUniqueKeys == 0 {
+		return errors.New("--strict requires --order-file or --max-unique-keys")
+	}
+	if o.maxUniqueKeys < 0 {
+		return errors.New("--max-unique-keys must not be negative")
+	}
+	if o.maxUniqueKeys > 0 && !o.unique {
+		return errors.New("--max-unique-keys requires -u")
+	}
+	if o.orderFile != "" {
+		order, err := loadOrderFile(o.orderFile)
+		if err != nil {
+			return err
+		}
+		o.order = order
+	}
+	if (o.passthroughOnEmpty || o.errorOnEmpty) && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent) {
+		return errors.New("--passthrough-on-empty and --error-on-empty cannot be combined with check, -m, --follow, --check-dupes-only or --dedup-adjacent mode")
+	}
+	if o.alphabet != "" {
+		rank, err := loadAlphabet(o.alphabet)
+		if err != nil {
+			return err
+		}
+		o.alphabetRank = rank
+	}
+	if o.wordWrap < 0 {
+		return errors.New("--word-wrap must not be negative")
+	}
+	if o.wordWrap > 0 && utf8.RuneCountInString(o.wrapIndent) >= o.wordWrap {
+		return errors.New("--wrap-indent must be shorter than the --word-wrap width")
+	}
+	if o.wordWrap > 0 && o.merge {
+		return errors.New("--word-wrap cannot be combined with -m")
+	}
+	if o.sortFromLine < 0 {
+		return errors.New("--sort-from-line must not be negative")
+	}
+	if o.sortToLine < -1 {
+		return errors.New("--sort-to-line must not be negative")
+	}
+	if o.sortToLine >= 0 && o.sortToLine < o.sortFromLine {
+		return errors.New("--sort-to-line must not be less than --sort-from-line")
+	}
+	if (o.sortFromLine > 0 || o.sortToLine >= 0) && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.chunkLines > 0 || o.splitTarget != "") {
+		return errors.New("--sort-from-line and --sort-to-line cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent, --chunk-lines or --split-by-key mode")
+	}
+	if o.keyLengthLimit < 0 {
+		return errors.New("--key-length-limit must not be negative")
+	}
+	if o.uniqueApprox != "" {
+		rate, err := strconv.ParseFloat(o.uniqueApprox, 64)
+		if err != nil || rate <= 0 || rate >= 1 {
+			return fmt.Errorf("invalid --unique-approx rate %q: want a number between 0 and 1", o.uniqueApprox)
+		}
+		o.approxRate = rate
+		if o.uniqueApproxSize < 1 {
+			return errors.New("--unique-approx-size must be positive")
+		}
+		if o.unique || o.numeric || o.human || o.month || o.reverse || o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent ||
+			o.chunkLines > 0 || o.splitTarget != "" || o.groupBy != nil || o.stableIndex || o.explain || o.sortFromLine > 0 || o.sortToLine >= 0 {
+			return errors.New("--unique-approx does not sort and cannot be combined with sort, -u or mode options")
+		}
+	}
+	if o.separatorAtEnd && o.fieldMapping == "" {
+		return errors.New("--separator-at-end requires --field-mapping")
+	}
+	if o.randomSubset < 0 {
+		return errors.New("--random-subset must not be negative")
+	}
+	if o.randomSeed != 0 && o.randomSubset == 0 {
+		return errors.New("--random-seed requires --random-subset")
+	}
+	if o.randomSubset > 0 && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "") {
+		return errors.New("--random-subset cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+	}
+	if o.filterPattern != "" {
+		re, err := regexp.Compile(o.filterPattern)
+		if err != nil {
+			return fmt.Errorf("invalid --filter: %v", err)
+		}
+		o.filterRe = re
+		if o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" ||
+			o.chunkLines > 0 || o.splitTarget != "" || o.groupBy != nil || o.randomSubset > 0 {
+			return errors.New("--filter cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent, --unique-approx, --chunk-lines, --split-by-key, --sort-groups or --random-subset")
+		}
+		// Pinned lines keep their input positions, which stop lining up
+		// once -u drops sorted lines.
+		if o.unique {
+			return errors.New("--filter cannot be combined with -u")
+		}
+	}
+	if o.excludeInvalid && o.validateKey == "" {
+		return errors.New("--exclude-invalid requires --validate-key")
+	}
+	if o.validateKey != "" {
+		re, err := regexp.Compile(o.validateKey)
+		if err != nil {
+			return fmt.Errorf("invalid --validate-key: %v", err)
+		}
+		o.validateRe = re
+		if o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" {
+			return errors.New("--validate-key cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+		}
+	}
+	if o.raw && (o.orderFile != "" || o.blanks || o.keyLengthLimit > 0) {
+		return errors.New("--raw cannot be combined with --order-file, -b or --key-length-limit")
+	}
+	if o.align && (o.zeroTerminated || o.nulDataOutput || o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" ||
+		o.chunkLines > 0 || o.splitTarget != "" || o.filterPattern != "" || o.sortToLine >= 0 ||
+		o.fieldMapping != "" || o.projectSpec != "" || o.formatOutput != "" || o.keysOnly || o.showKeys || o.outputSeparator != "" || o.wordWrap > 0) {
+		return errors.New("--align cannot be combined with -z, modes that do not print the sorted lines, --filter, --sort-to-line or other output formatting options")
+	}
+	if o.uniqueKeyColumn > 0 || o.uniqueKeyLast {
+		if o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" || o.filterPattern != "" {
+			return errors.New("--unique-key cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode, or with --filter")
+		}
+		o.uniqueKey = fieldKey{o.uniqueKeyColumn, o.separator, o.quote}
+		if o.uniqueKeyLast {
+			o.uniqueKey = lastFieldKey{o.separator, o.quote}
+		}
+	}
+	if o.includeFile != "" && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "") {
+		return errors.New("--include-file cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+	}
+	if o.excludeFile != "" && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "") {
+		return errors.New("--exclude-file cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+	}
+	if o.outputOffset < 0 {
+		return errors.New("--output-offset must not be negative")
+	}
+	if (o.outputLimit >= 0 || o.outputOffset > 0) && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" ||
+		o.filterPattern != "" || o.sortFromLine > 0 || o.sortToLine >= 0) {
+		return errors.New("--head-count, --output-limit and --output-offset cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode, --filter, --sort-from-line or --sort-to-line")
+	}
+	if o.printPositions && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "" || o.chunkLines > 0 || o.splitTarget != "" ||
+		o.filterPattern != "" || o.stableIndex || o.headerFile != "" || o.sortFromLine > 0 || o.sortToLine >= 0) {
+		return errors.New("--print-positions cannot be combined with modes that do not print every sorted line, or with --filter, --stable-index, --header-file, --sort-from-line or --sort-to-line")
+	}
+	if o.collisionSkipEmpty && o.collisionLog == "" {
+		return errors.New("--collision-skip-empty requires --key-collision-log")
+	}
+	if o.keyPositionMap != "" && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "") {
+		return errors.New("--key-position-map cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+	}
+	if o.collisionLog != "" && (o.check || o.merge || o.follow || o.checkDupesOnly || o.dedupAdjacent || o.uniqueApprox != "") {
+		return errors.New("--key-collision-log cannot be combined with check, -m, --follow, --check-dupes-only, --dedup-adjacent or --unique-approx mode")
+	}
+	if o.inverseSort && (o.unique || o.groupBy != nil || o.randomSubset > 0 || o.filterPattern != "" || o.check || o.merge || o.follow || o.checkDupesOnly ||
+		o.dedupAdjacent || o.uniqueApprox != "" || o.sortFromLine > 0 || o.sortToLine >= 0 || o.explain) {
+		return errors.New("--inverse-sort needs the plain sort permutation and cannot be combined with -u, --sort-groups, --random-subset, --filter, --sort-from-line, --sort-to-line, --explain or another mode")
+	}
+	if o.explain && (o.check || o.merge || o.follow || o.checkDupesOnly || o.groupBy != nil) {
+		return errors.New("--explain cannot be combined with check, -m, --follow, --check-dupes-only or --sort-groups mode")
+	}
+	if o.explainLimit < 0 {
+		return errors.New("--explain-limit must not be negative")
+	}
+	if o.follow && o.check {
+		return errors.New("cannot combine --follow and check mode")
+	}
+	return nil
+}
+
+// comparisonModes names the options given that each replace how keys
+// compare; validate allows at most one. The options that compare a
+// computed number are forms of -n and share its entry.
+func (o *options) comparisonModes() []string {
+	numeric := "-n"
+	switch {
+	case o.fieldCompute != "":
+		numeric = "--field-compute"
+	case o.extractNumber:
+		numeric = "--extract-number"
+	case o.byCount:
+		numeric = "--by-count"
+	}
+	var modes []string
+	for _, mode := range []struct {
+		set  bool
+		name string
+	}{
+		{o.numeric || o.fieldCompute != "" || o.extractNumber || o.byCount, numeric},
+		{o.human, "-h"},
+		{o.month, "-M"},
+		{o.foldCase, "-f"},
+		{o.raw, "--raw"},
+		{o.paths, "--paths"},
+		{o.domain, "--domain"},
+		{o.email, "--email"},
+		{o.url != "", "--url"},
+		{o.uuid != "", "--uuid"},
+		{o.byEntropy, "--by-entropy"},
+		{o.byDistance != "", "--by-distance"},
+		{o.byJaroWinkler != "", "--by-jaro-winkler"},
+		{o.byNumericPrefix, "--by-numeric-prefix"},
+		{o.alphabet != "", "--alphabet"},
+		{o.byChecksum != "", "--by-checksum"},
+		{o.byteLength > 0, "--byte-length"},
+	} {
+		if mode.set {
+			modes = append(modes, mode.name)
+		}
+	}
+	return modes
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// lineWriter writes sorted lines to the output, applying the options
+// that change how each line is printed.
+type lineWriter struct {
+	w            *bufio.Writer
+	sorter       byKey
+	showKeys     bool               // prefix lines with "KEY\t"
+	keysOnly     bool               // print the key instead of the line
+	fieldMap     []int              // --field-mapping indices, 0 meaning the whole line
+	project      []int              // --project fields, projectKey meaning the key
+	sepAtEnd     bool               // end --field-mapping output with the separator
+	sep          string             // -t separator used to split and rejoin fields
+	quote        byte               // --field-quote-char, or 0
+	outSep       string             // --output-separator to rejoin fields with, "" for sep
+	eol          byte               // record terminator written after each line
+	format       *template.Template // --format-output, or nil
+	stableIndex  bool               // prefix lines with their 1-based input position
+	wrapWidth    int                // --word-wrap width in characters, 0 for none
+	wrapIndent   string             // prefix of wrapped continuation lines
+	lineBuffered bool               // flush after every line
+	align        *aligner           // --align, or nil
+}
+
+// writeLine writes one output line.
+func (lw *lineWriter) writeLine(line string) error {
+	text, err := lw.render(line)
+	if err != nil {
+		return err
+	}
+	return lw.emit(text)
+}
+
+// writeIndexed is writeLine for a line whose 0-based input position is
+// known; with --stable-index the 1-based position and a tab come first.
+func (lw *lineWriter) writeIndexed(line string, pos int) error {
+	text, err := lw.render(line)
+	if err != nil {
+		return err
+	}
+	if lw.stableIndex {
+		text = strconv.Itoa(pos+1) + "\t" + text
+	}
+	return lw.emit(text)
+}
+
+// emit writes a rendered line and its terminator, wrapped first when
+// --word-wrap is set, and flushes it with --line-buffered.
+func (lw *lineWriter) emit(text string) error {
+	if err := lw.write(text); err != nil || !lw.lineBuffered {
+		return err
+	}
+	return lw.w.Flush()
+}
+
+// writeRaw writes a line as it is, bypassing the output options, as for
+// the lines --filter pins (counted like any other output line). Like
+// emit, it flushes with --line-buffered.
+func (lw *lineWriter) writeRaw(line string) error {
+	lw.countLine()
+	lw.w.WriteString(line)
+	if err := lw.w.WriteByte(lw.eol); err != nil || !lw.lineBuffered {
+		return err
+	}
+	return lw.w.Flush()
+}
+
+// countLine counts one output line for --output-stats.
+func (lw *lineWriter) countLine() {
+	if lw.sorter.stats != nil {
+		lw.sorter.stats.linesWritten++
+	}
+}
+
+// write is emit without the --line-buffered flush.
+func (lw *lineWriter) write(text string) error {
+	lw.countLine()
+	if lw.wrapWidth <= 0 {
+		lw.w.WriteString(text)
+		return lw.w.WriteByte(lw.eol)
+	}
+	for _, piece := range wrapLine(text, lw.wrapWidth, lw.wrapIndent) {
+		lw.w.WriteString(piece)
+		if err := lw.w.WriteByte(lw.eol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render applies the output options to one line, without the terminator.
+func (lw *lineWriter) render(line string) (string, error) {
+	orig := line
+	if lw.keysOnly {
+		line = lw.sorter.comparedKey(orig)
+	}
+	joinSep := lw.sep
+	if lw.outSep != "" {
+		joinSep = lw.outSep
+	}
+	switch {
+	case lw.fieldMap != nil:
+		line = mapFields(line, lw.fieldMap, lw.sep, lw.quote, joinSep)
+		if lw.sepAtEnd {
+			line += joinSep
+		}
+	case lw.project != nil:
+		line = projectFields(line, lw.sorter.comparedKey(orig), lw.project, lw.sep, lw.quote, joinSep)
+	case lw.align != nil:
+		line = lw.align.format(line)
+	case lw.outSep != "" && !lw.keysOnly:
+		line = strings.Join(splitFields(line, lw.sep, lw.quote), joinSep)
+	}
+	if lw.format != nil {
+		var b strings.Builder
+		data := formatData{orig, lw.sorter.comparedKey(orig), splitFields(orig, lw.sep, lw.quote)}
+		if err := lw.format.Execute(&b, data); err != nil {
+			return "", err
+		}
+		line = b.String()
+	}
+	if lw.showKeys {
+		line = lw.sorter.shownKey(orig) + "\t" + line
+	}
+	return line, nil
+}
+
+// wrapLine breaks text into pieces of at most width characters at
+// spaces, prefixing every piece after the first with indent. A word that
+// does not fit on a line by itself is left whole.
+func wrapLine(text string, width int, indent string) []string {
+	if utf8.RuneCountInString(text) <= width {
+		return []string{text}
+	}
+	pieces := []string{}
+	current, currentLen := "", 0
+	for _, word := range strings.Split(text, " ") {
+		wordLen := utf8.RuneCountInString(word)
+		switch {
+		case currentLen == 0 && len(pieces) == 0:
+			current, currentLen = word, wordLen
+		case currentLen == 0:
+			current, currentLen = indent+word, utf8.RuneCountInString(indent)+wordLen
+		case currentLen+1+wordLen <= width:
+			current += " " + word
+			currentLen += 1 + wordLen
+		default:
+			pieces = append(pieces, current)
+			current, currentLen = indent+word, utf8.RuneCountInString(indent)+wordLen
+		}
+	}
+	return append(pieces, current)
+}
+
+// formatData is what a --format-output template is executed with.
+type formatData struct {
+	Line   string
+	Key    string
+	Fields []string
+}
+
+// aligner is --align: it pads the fields of each line to the widest
+// field of its column and joins them with two spaces.
+type aligner struct {
+	widths []int // width of each column in runes
+	right  int   // 1-based column padded on the left, 0 for none
+	sep    string
+	quote  byte
+}
+
+// newAligner measures the columns of lines. The right column, if any, is
+// the -n sort key, which reads best right-aligned.
+func newAligner(lines []string, sep string, quote byte, right int) *aligner {
+	a := &aligner{right: right, sep: sep, quote: quote}
+	for _, line := range lines {
+		for i, field := range splitFields(line, sep, quote) {
+			if i == len(a.widths) {
+				a.widths = append(a.widths, 0)
+			}
+			a.widths[i] = max(a.widths[i], utf8.RuneCountInString(field))
+		}
+	}
+	return a
+}
+
+// format pads the fields of line. The last field is not padded on the
+// right, so lines carry no trailing blanks.
+func (a *aligner) format(line string) string {
+	fields := splitFields(line, a.sep, a.quote)
+	for i, field := range fields {
+		pad := strings.Repeat(" ", a.widths[i]-utf8.RuneCountInString(field))
+		switch {
+		case i+1 == a.right:
+			fields[i] = pad + field
+		case i < len(fields)-1:
+			fields[i] = field + pad
+		}
+	}
+	return strings.Join(fields, "  ")
+}
+
+// isRegularFile reports whether w is an *os.File for a regular file,
+// where --line-buffered gains nothing.
+func isRegularFile(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// flush flushes the buffered output.
+func (lw *lineWriter) flush() error { return lw.w.Flush() }
+
+// mapFields rebuilds line from the listed 1-based fields, split on sep
+// and joined with joinSep. Index 0 stands for the whole line and missing
+// fields are empty.
+func mapFields(line string, indices []int, sep string, quote byte, joinSep string) string {
+	fields := splitFields(line, sep, quote)
+	out := make([]string, len(indices))
+	for i, idx := range indices {
+		switch {
+		case idx == 0:
+			out[i] = line
+		case idx <= len(fields):
+			out[i] = fields[idx-1]
+		}
+	}
+	return strings.Join(out, joinSep)
+}
+
+// projectKey stands for the compared key in a --project list.
+const projectKey = -1
+
+// projectFields is mapFields for --project: the listed 1-based fields,
+// with projectKey giving key, split on sep and joined with joinSep.
+// Fields past the end of the line are empty.
+func projectFields(line, key string, indices []int, sep string, quote byte, joinSep string) string {
+	fields := splitFields(line, sep, quote)
+	out := make([]string, len(indices))
+	for i, idx := range indices {
+		switch {
+		case idx == projectKey:
+			out[i] = key
+		case idx <= len(fields):
+			out[i] = fields[idx-1]
+		}
+	}
+	return strings.Join(out, joinSep)
+}
+
+// parseProjection parses a --project list such as "1,3", "2-5" or
+// "key,1".
+func parseProjection(spec string) ([]int, error) {
+	indices := []int{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "key" {
+			indices = append(indices, projectKey)
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		last := first
+		if err == nil && isRange {
+			last, err = strconv.Atoi(hi)
+		}
+		if err != nil || first < 1 || last < first {
+			return nil, fmt.Errorf("invalid --project field %q", part)
+		}
+		for idx := first; idx <= last; idx++ {
+			indices = append(indices, idx)
+		}
+	}
+	return indices, nil
+}
+
+// parseFieldMapping parses a --field-mapping list such as "2,1,3".
+func parseFieldMapping(spec string) ([]int, error) {
+	indices := []int{}
+	for _, part := range strings.Split(spec, ",") {
+		idx, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("invalid --field-mapping index %q", part)
+		}
+		indices = append(indices, idx)
+	}
+	return indices, nil
+}
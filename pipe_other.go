@@ -0,0 +1,14 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// brokenPipe reports whether err comes from writing to a pipe whose
+// reader has gone.
+func brokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
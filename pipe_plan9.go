@@ -0,0 +1,10 @@
+package main
+
+import "strings"
+
+// brokenPipe reports whether err comes from writing to a pipe whose
+// reader has gone. Plan 9 has no EPIPE; the write fails on a hungup
+// channel instead.
+func brokenPipe(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "i/o on hungup channel")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+)
+
+// startProfiles starts the --cpuprofile and --memprofile profiles; either
+// name may be empty. The returned function stops the CPU profile and
+// writes the heap profile. It runs at most once, from a defer or from the
+// signal hook, so the profiles are complete however the run ends.
+func startProfiles(cpuName, memName string) (func() error, error) {
+	var cpu *os.File
+	if cpuName != "" {
+		f, err := os.Create(cpuName)
+		if err != nil {
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("--cpuprofile: %v", err)
+		}
+		cpu = f
+	}
+	var once sync.Once
+	var stopErr error
+	stop := func() error {
+		once.Do(func() {
+			if cpu != nil {
+				pprof.StopCPUProfile()
+				stopErr = cpu.Close()
+			}
+			if memName != "" {
+				if err := writeHeapProfile(memName); stopErr == nil {
+					stopErr = err
+				}
+			}
+		})
+		return stopErr
+	}
+	unhook := onSignal(func() { stop() })
+	return func() error {
+		unhook()
+		return stop()
+	}, nil
+}
+
+// writeHeapProfile writes the --memprofile file after a collection, so it
+// shows live memory as of the end of the run.
+func writeHeapProfile(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
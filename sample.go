@@ -0,0 +1,32 @@
+package main
+
+import "math/rand"
+
+// reservoir keeps a uniform random sample of at most k lines from a
+// stream of unknown length, using Algorithm R: the n-th line replaces a
+// random sampled one with probability k/n.
+type reservoir struct {
+	k         int
+	rng       *rand.Rand
+	seen      int
+	lines     []string
+	positions []int // input position of each sampled line
+}
+
+func newReservoir(k int, seed int64) *reservoir {
+	return &reservoir{k: k, rng: rand.New(rand.NewSource(seed))}
+}
+
+// add offers the line at input position pos to the sample.
+func (r *reservoir) add(line string, pos int) {
+	r.seen++
+	if len(r.lines) < r.k {
+		r.lines = append(r.lines, line)
+		r.positions = append(r.positions, pos)
+		return
+	}
+	if j := r.rng.Intn(r.seen); j < r.k {
+		r.lines[j] = line
+		r.positions[j] = pos
+	}
+}
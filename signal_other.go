@@ -0,0 +1,18 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// exitSignals are the signals that run the signal hooks. Only an
+// interrupt is portable.
+var exitSignals = []os.Signal{os.Interrupt}
+
+// signalStatus is the exit status after sig. An interrupt exits with
+// 130, the status a Unix shell gives SIGINT.
+func signalStatus(sig os.Signal) int {
+	if sig == os.Interrupt {
+		return 130
+	}
+	return 1
+}
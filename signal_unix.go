@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitSignals are the signals that run the signal hooks.
+var exitSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
+// signalStatus is the exit status after sig: 128 plus its number, as a
+// shell reports it.
+func signalStatus(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// signalHooks are the cleanups to run when an interrupt or termination
+// signal arrives, after which the process exits with status 128+signal.
+// While none is registered no handler is installed, so an in-memory sort
+// still dies at once.
+var signalHooks struct {
+	mu      sync.Mutex
+	next    int
+	hooks   map[int]func()
+	signals chan os.Signal
+}
+
+// onSignal registers fn as a signal hook and returns the function that
+// unregisters it again.
+func onSignal(fn func()) (remove func()) {
+	h := &signalHooks
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.signals == nil {
+		h.hooks = map[int]func(){}
+		h.signals = make(chan os.Signal, 1)
+		signal.Notify(h.signals, exitSignals...)
+		go handleSignals(h.signals)
+	}
+	id := h.next
+	h.next++
+	h.hooks[id] = fn
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.hooks, id)
+		if len(h.hooks) == 0 && h.signals != nil {
+			signal.Stop(h.signals)
+			close(h.signals)
+			h.signals = nil
+		}
+	}
+}
+
+func handleSignals(signals chan os.Signal) {
+	sig, ok := <-signals
+	if !ok {
+		return
+	}
+	// The hooks run unlocked, so one may wait for a lock held by code
+	// that is registering another hook.
+	h := &signalHooks
+	h.mu.Lock()
+	hooks := make([]func(), 0, len(h.hooks))
+	for id := 0; id < h.next; id++ {
+		if fn, ok := h.hooks[id]; ok {
+			hooks = append(hooks, fn)
+		}
+	}
+	h.mu.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+	os.Exit(signalStatus(sig))
+}
+
+// tempFiles tracks the temporary files of one run. While any exist, an
+// interrupt or termination signal removes them before the process exits.
+type tempFiles struct {
+	mu     sync.Mutex
+	names  []string
+	unhook func() // unregisters the signal hook, once one is registered
+}
+
+// create makes a new temporary file, as os.CreateTemp, and tracks it.
+func (t *tempFiles) create(pattern string) (*os.File, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.unhook == nil {
+		t.unhook = onSignal(t.removeOnSignal)
+	}
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+	t.names = append(t.names, f.Name())
+	return f, nil
+}
+
+// removeOnSignal is the signal hook. It keeps the lock, so create cannot
+// add files behind our back before the process exits.
+func (t *tempFiles) removeOnSignal() {
+	t.mu.Lock()
+	for _, name := range t.names {
+		os.Remove(name)
+	}
+}
+
+// removeAll deletes every tracked file and uninstalls the signal hook.
+func (t *tempFiles) removeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, name := range t.names {
+		os.Remove(name)
+	}
+	t.names = nil
+	if t.unhook != nil {
+		t.unhook()
+		t.unhook = nil
+	}
+}